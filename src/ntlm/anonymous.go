@@ -0,0 +1,66 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"bytes"
+	"ntlm/messages"
+)
+
+// Returned when a client authenticates anonymously and the server does not allow it
+var ErrAnonymousNotAllowed = newAuthenticationError("Anonymous authentication is not allowed")
+
+// Set whether a server accepts anonymous (null session) authentication, it is refused by default
+func (n *SessionData) SetAllowAnonymous(allow bool) {
+	n.allowAnonymous = allow
+}
+
+// True when the client authenticated anonymously, the user and domain are empty in that case
+func (n *SessionData) IsAnonymous() bool {
+	return n.anonymous
+}
+
+// A client authenticates anonymously when neither a user nor a password or credential is set
+func (n *SessionData) anonymousClient() bool {
+	return n.user == "" && n.password == "" && n.credential == nil
+}
+
+// An anonymous AUTHENTICATE_MESSAGE has no user name, an empty NtChallengeResponse and a LmChallengeResponse of Z(1)
+func isAnonymousAuthenticate(am *messages.Authenticate) bool {
+	lmResponse := am.LmChallengeResponse.Payload
+	return am.UserName.Len == 0 && am.NtChallengeResponseFields.Len == 0 && (len(lmResponse) == 0 || bytes.Equal(lmResponse, zeroBytes(1)))
+}
+
+// The responses of an anonymous client as defined by MS-NLMP, the session base key is Z(16)
+func (n *SessionData) computeAnonymousResponses() {
+	n.ntChallengeResponse = make([]byte, 0)
+	n.lmChallengeResponse = zeroBytes(1)
+	n.sessionBaseKey = zeroBytes(16)
+	n.keyExchangeKey = n.sessionBaseKey
+	n.negotiatedFlags = messages.NTLMSSP_ANONYMOUS.Set(n.negotiatedFlags)
+	n.NegotiateFlags = messages.NTLMSSP_ANONYMOUS.Set(n.NegotiateFlags)
+}
+
+// Accept an anonymous authenticate message if the policy allows it, an anonymous client can not send channel bindings
+// or a target name
+func (n *SessionData) acceptAnonymous() (err error) {
+	if !n.allowAnonymous {
+		return ErrAnonymousNotAllowed
+	}
+
+	err = n.verifyChannelBindings(nil)
+	if err != nil {
+		return err
+	}
+
+	err = n.verifyTargetName(nil)
+	if err != nil {
+		return err
+	}
+
+	n.anonymous = true
+	n.user = ""
+	n.userDomain = ""
+	n.sessionBaseKey = zeroBytes(16)
+	n.keyExchangeKey = n.sessionBaseKey
+	return nil
+}
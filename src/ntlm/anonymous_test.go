@@ -0,0 +1,47 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+)
+
+func TestAnonymous(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		server, _ := CreateServerSession(version, ConnectionOrientedMode)
+		server.SetAllowAnonymous(true)
+		client, _ := CreateClientSession(version, ConnectionOrientedMode)
+		runHandshake(t, client, server)
+
+		if !server.IsAnonymous() {
+			t.Errorf("NTLMv%d: Server did not report an anonymous client", version)
+		}
+		user, _, domain := server.GetUserInfo()
+		if user != "" || domain != "" {
+			t.Errorf("NTLMv%d: Anonymous client should have no user or domain but was %s\\%s", version, domain, user)
+		}
+		authenticate := server.GetSessionData().authenticateMessage
+		if authenticate.NtChallengeResponseFields.Len != 0 || authenticate.LmChallengeResponse.Len != 1 {
+			t.Errorf("NTLMv%d: Anonymous client should send an empty NT response and Z(1) as LM response", version)
+		}
+		if !messages.NTLMSSP_ANONYMOUS.IsSet(authenticate.NegotiateFlags) {
+			t.Errorf("NTLMv%d: Anonymous client should set NTLMSSP_ANONYMOUS", version)
+		}
+		checkSealUnseal(t, client, server, 0)
+
+		// Anonymous clients are refused by default
+		server, _ = CreateServerSession(version, ConnectionOrientedMode)
+		client, _ = CreateClientSession(version, ConnectionOrientedMode)
+		if err := handshakeError(client, server); err != ErrAnonymousNotAllowed {
+			t.Errorf("NTLMv%d: Expected ErrAnonymousNotAllowed but got %v", version, err)
+		}
+	}
+
+	// A user with the wrong password is not treated as anonymous
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	server.SetAllowAnonymous(true)
+	client.SetUserInfo("User", "", "Domain")
+	if handshakeError(client, server) == nil || server.IsAnonymous() {
+		t.Error("User with an empty password was authenticated")
+	}
+}
@@ -0,0 +1,80 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+)
+
+// A server session that accepts both NTLMv1 and NTLMv2 clients. The type of the response is detected from the
+// authenticate message and it is verified as NTLMv1, NTLMv1 with extended session security or NTLMv2, subject to
+// the LmCompatibilityLevel of the session. Without a level only NTLMv2 is accepted, NTLMv1 responses are refused
+// with ErrLmCompatibilityLevel unless a level below LmCompatibilityLevel5 is set.
+type AutoServerSession struct {
+	V2ServerSession
+	version int
+}
+
+// The flags the server supports unless SetSupportedFlags is used, NTLMv1 clients without extended session security
+// may also use the LM key
+func (n *AutoServerSession) serverFlags() uint32 {
+	flags := uint32(0)
+	flags = messages.NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_VERSION.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_LM_KEY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_TARGET_INFO.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_NTLM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SEAL.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = messages.NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = messages.NTLM_NEGOTIATE_OEM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_128.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_56.Set(flags)
+
+	return n.offeredFlags(flags)
+}
+
+func (n *AutoServerSession) GenerateChallengeMessage() (cm *messages.Challenge, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.generateChallengeMessage(n.serverFlags())
+}
+
+func (n *AutoServerSession) ProcessAuthenticateMessage(am *messages.Authenticate) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err = n.checkState(stateChallenged)
+	if err != nil {
+		return err
+	}
+	err = n.advance(stateAuthenticated, n.processAuthenticateMessage(am))
+	n.logAuthenticateResult(n.Version(), err)
+	return err
+}
+
+func (n *AutoServerSession) processAuthenticateMessage(am *messages.Authenticate) (err error) {
+	n.version = am.NtlmVersion()
+	if n.version != 1 {
+		return n.V2ServerSession.processAuthenticateMessage(am)
+	}
+	// Detecting the version must not accept more than the level allows
+	if n.lmCompatibilityLevel == nil {
+		return ErrLmCompatibilityLevel
+	}
+
+	// An NTLMv1 response is verified by an NTLMv1 session on a copy of the session data. Signing and sealing work the
+	// same for both versions so the resulting keys are all that is needed afterwards.
+	v1 := new(V1ServerSession)
+	v1.SessionData = n.SessionData
+	err = v1.processAuthenticateMessage(am)
+	n.SessionData = v1.SessionData
+	return err
+}
+
+// The NTLM version of the response the client sent, 0 until an authenticate message with an NT response is processed
+func (n *AutoServerSession) Version() int {
+	return n.version
+}
@@ -0,0 +1,65 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+)
+
+func TestAutoServerSession(t *testing.T) {
+	v1NoEss := newTestClient(t, Version1, ConnectionOrientedMode)
+	v1NoEss.SetSupportedFlags(v1NoEss.(*V1ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY))
+
+	tests := []struct {
+		name    string
+		client  ClientSession
+		version int
+	}{
+		{"NTLMv1", newTestClient(t, Version1, ConnectionOrientedMode), 1},
+		{"NTLMv1 without extended session security", v1NoEss, 1},
+		{"NTLMv2", newTestClient(t, Version2, ConnectionOrientedMode), 2},
+	}
+
+	for _, test := range tests {
+		server := newTestServer(t, VersionAuto, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		runHandshake(t, test.client, server)
+		if server.Version() != test.version {
+			t.Errorf("%s: detected version %d", test.name, server.Version())
+		}
+		checkSealUnseal(t, test.client, server, 0)
+
+		test.client.SetUserInfo("User", "Wrong", "Domain")
+		server = newTestServer(t, VersionAuto, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		if err := handshakeError(test.client, server); err == nil {
+			t.Errorf("%s: should not authenticate with the wrong password", test.name)
+		}
+	}
+}
+
+func TestAutoServerSessionLmCompatibilityLevel(t *testing.T) {
+	// Without a level NTLMv1 is refused
+	if err := handshakeError(newTestClient(t, Version1, ConnectionOrientedMode), newTestServer(t, VersionAuto, ConnectionOrientedMode)); err != ErrLmCompatibilityLevel {
+		t.Errorf("Expected ErrLmCompatibilityLevel for an NTLMv1 response without a level but got %v", err)
+	}
+
+	server := newTestServer(t, VersionAuto, ConnectionOrientedMode)
+	server.SetLmCompatibilityLevel(LmCompatibilityLevel5)
+	if err := handshakeError(newTestClient(t, Version1, ConnectionOrientedMode), server); err != ErrLmCompatibilityLevel {
+		t.Errorf("Expected ErrLmCompatibilityLevel for an NTLMv1 response at level 5 but got %v", err)
+	}
+
+	server = newTestServer(t, VersionAuto, ConnectionOrientedMode)
+	server.SetLmCompatibilityLevel(LmCompatibilityLevel5)
+	runHandshake(t, newTestClient(t, Version2, ConnectionOrientedMode), server)
+}
+
+func TestServerSessionRejectsOtherVersion(t *testing.T) {
+	if err := handshakeError(newTestClient(t, Version1, ConnectionOrientedMode), newTestServer(t, Version2, ConnectionOrientedMode)); err == nil {
+		t.Error("An NTLMv2 server should not accept an NTLMv1 response")
+	}
+	if err := handshakeError(newTestClient(t, Version2, ConnectionOrientedMode), newTestServer(t, Version1, ConnectionOrientedMode)); err == nil {
+		t.Error("An NTLMv1 server should not accept an NTLMv2 response")
+	}
+}
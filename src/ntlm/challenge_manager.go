@@ -0,0 +1,184 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var (
+	// The server challenge was not issued to the session by the challenge manager or has already been used
+	ErrChallengeUnknown = newAuthenticationError("Server challenge was not issued or has already been used")
+	// The server challenge was issued but its time to live has passed
+	ErrChallengeExpired = newAuthenticationError("Server challenge has expired")
+	// The response to a challenge has been seen before
+	ErrResponseReplayed = newAuthenticationError("Challenge response has already been used")
+)
+
+// Identifies the handshake a challenge was issued to, a challenge can only be used with the handle it was issued with
+type ChallengeHandle uint64
+
+// A challenge that was issued and not used yet
+type issuedChallenge struct {
+	challenge []byte
+	expiry    time.Time
+}
+
+// An entry of the expiry queue, the key is the ChallengeHandle of a challenge or the hex string of a response
+type expiryEntry struct {
+	expiry time.Time
+	key    interface{}
+}
+
+// A min-heap of expiry entries, the entry that expires first is at the top
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].expiry.Before(q[j].expiry) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// A ChallengeManager issues the server challenges for many server sessions and keeps track of them. Each challenge is
+// bound to the handshake it was issued to, expires after a time to live and can only be used by one authenticate
+// message. The NTProofStr (or NTLMv1 response) of each accepted authenticate message is remembered so it can not be
+// replayed. It is safe for concurrent use.
+type ChallengeManager struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+
+	// The challenges that were issued and not used yet, and the last handle that was given out
+	issued     map[ChallengeHandle]issuedChallenge
+	lastHandle ChallengeHandle
+	// Expiry time of the responses that were accepted
+	responses map[string]time.Time
+	// The challenges and responses in the order they expire
+	expiries expiryQueue
+
+	now func() time.Time
+}
+
+func NewChallengeManager(ttl time.Duration) *ChallengeManager {
+	m := new(ChallengeManager)
+	m.ttl = ttl
+	m.issued = make(map[ChallengeHandle]issuedChallenge)
+	m.responses = make(map[string]time.Time)
+	m.now = time.Now
+	return m
+}
+
+// Issue a new random 8 byte server challenge, it can only be used with the handle that is returned with it
+func (m *ChallengeManager) Issue() (ChallengeHandle, []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.prune()
+
+	m.lastHandle++
+	challenge := randomBytes(8)
+	expiry := m.now().Add(m.ttl)
+	m.issued[m.lastHandle] = issuedChallenge{challenge: challenge, expiry: expiry}
+	heap.Push(&m.expiries, expiryEntry{expiry: expiry, key: m.lastHandle})
+	return m.lastHandle, challenge
+}
+
+// Mark the challenge issued with the handle as used, an error is returned when the challenge was not issued with the
+// handle, is already used or expired
+func (m *ChallengeManager) UseChallenge(handle ChallengeHandle, challenge []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The challenge of the handle is looked up before the expired ones are pruned, so that it is reported as expired
+	// rather than unknown. It can not be used any more, whether or not it is the one given.
+	issued, ok := m.issued[handle]
+	delete(m.issued, handle)
+	m.prune()
+	if !ok {
+		return ErrChallengeUnknown
+	}
+	if !bytes.Equal(issued.challenge, challenge) {
+		return ErrChallengeUnknown
+	}
+	if m.now().After(issued.expiry) {
+		return ErrChallengeExpired
+	}
+	return nil
+}
+
+// Remember an accepted response, an error is returned when the same response was accepted before
+func (m *ChallengeManager) UseResponse(proof []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.prune()
+
+	key := hex.EncodeToString(proof)
+	if _, ok := m.responses[key]; ok {
+		return ErrResponseReplayed
+	}
+	expiry := m.now().Add(m.ttl)
+	m.responses[key] = expiry
+	heap.Push(&m.expiries, expiryEntry{expiry: expiry, key: key})
+	return nil
+}
+
+// The number of issued challenges that have not been used yet
+func (m *ChallengeManager) Pending() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.prune()
+	return len(m.issued)
+}
+
+// Remove the challenges and responses that expired, only the entries at the top of the expiry queue are looked at. A
+// response only has to be remembered as long as the challenge it answers could be used.
+func (m *ChallengeManager) prune() {
+	now := m.now()
+	for len(m.expiries) > 0 && now.After(m.expiries[0].expiry) {
+		entry := heap.Pop(&m.expiries).(expiryEntry)
+		switch key := entry.key.(type) {
+		case ChallengeHandle:
+			delete(m.issued, key)
+		case string:
+			delete(m.responses, key)
+		}
+	}
+}
+
+// Set the challenge manager a server session uses to issue and check its server challenges
+func (n *SessionData) SetChallengeManager(manager *ChallengeManager) {
+	n.challengeManager = manager
+}
+
+// A new server challenge, issued by the challenge manager to this session when there is one
+func (n *SessionData) newServerChallenge() []byte {
+	if n.challengeManager != nil {
+		var challenge []byte
+		n.challengeHandle, challenge = n.challengeManager.Issue()
+		return challenge
+	}
+	return randomBytes(8)
+}
+
+// Mark the server challenge of the session as used, called for every authenticate message. The challenge must have
+// been issued to this session, a challenge of another session set with SetServerChallenge is refused.
+func (n *SessionData) useServerChallenge() error {
+	if n.challengeManager == nil {
+		return nil
+	}
+	return n.challengeManager.UseChallenge(n.challengeHandle, n.serverChallenge)
+}
+
+// Remember the response of an authenticated user so that it can not be replayed
+func (n *SessionData) useResponse(proof []byte) error {
+	if n.challengeManager == nil {
+		return nil
+	}
+	return n.challengeManager.UseResponse(proof)
+}
@@ -0,0 +1,115 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+	"time"
+)
+
+func TestChallengeManager(t *testing.T) {
+	now := time.Now()
+	m := NewChallengeManager(time.Minute)
+	m.now = func() time.Time { return now }
+
+	firstHandle, first := m.Issue()
+	secondHandle, second := m.Issue()
+	thirdHandle, third := m.Issue()
+	if m.Pending() != 3 {
+		t.Errorf("Expected 3 pending challenges but there were %d", m.Pending())
+	}
+	if err := m.UseChallenge(firstHandle, first); err != nil {
+		t.Errorf("Could not use an issued challenge: %s", err)
+	}
+	if err := m.UseChallenge(firstHandle, first); err != ErrChallengeUnknown {
+		t.Errorf("Expected ErrChallengeUnknown when a challenge is used twice but got %v", err)
+	}
+	if err := m.UseChallenge(secondHandle, []byte("12345678")); err != ErrChallengeUnknown {
+		t.Errorf("Expected ErrChallengeUnknown for a challenge that was not issued but got %v", err)
+	}
+	if err := m.UseChallenge(secondHandle, second); err != ErrChallengeUnknown {
+		t.Errorf("Expected ErrChallengeUnknown for a handle that tried another challenge but got %v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	fourthHandle, fourth := m.Issue()
+	now = now.Add(45 * time.Second)
+	if err := m.UseChallenge(thirdHandle, third); err != ErrChallengeExpired {
+		t.Errorf("Expected ErrChallengeExpired for the expired challenge but got %v", err)
+	}
+	if err := m.UseChallenge(thirdHandle, third); err != ErrChallengeUnknown {
+		t.Errorf("Expected the expired challenge to be forgotten but got %v", err)
+	}
+	if m.Pending() != 1 {
+		t.Errorf("Expected 1 pending challenge but there were %d", m.Pending())
+	}
+	if err := m.UseChallenge(fourthHandle, fourth); err != nil {
+		t.Errorf("Could not use a challenge within its time to live: %s", err)
+	}
+	if m.Pending() != 0 {
+		t.Errorf("Expected no pending challenges but there were %d", m.Pending())
+	}
+
+	if err := m.UseResponse([]byte("proof")); err != nil {
+		t.Errorf("Could not use a new response: %s", err)
+	}
+	if err := m.UseResponse([]byte("proof")); err != ErrResponseReplayed {
+		t.Errorf("Expected ErrResponseReplayed but got %v", err)
+	}
+}
+
+func TestChallengeManagerReplay(t *testing.T) {
+	m := NewChallengeManager(time.Minute)
+	for _, version := range []Version{Version1, Version2} {
+		client, server := newTestSessions(t, version, ConnectionOrientedMode)
+		server.SetChallengeManager(m)
+
+		negotiate, _ := client.GenerateNegotiateMessage()
+		server.ProcessNegotiateMessage(negotiate)
+		challenge, _ := server.GenerateChallengeMessage()
+		client.ProcessChallengeMessage(challenge)
+		authenticate, _ := client.GenerateAuthenticateMessage()
+		authenticateBytes := authenticate.Bytes()
+
+		authenticate, _ = messages.ParseAuthenticateMessage(authenticateBytes)
+		if err := server.ProcessAuthenticateMessage(authenticate); err != nil {
+			t.Errorf("NTLMv%d: Could not process authenticate message: %s", version, err)
+		}
+
+		// Replaying the message against another session with the same challenge must fail
+		replay := newTestServer(t, version, ConnectionOrientedMode)
+		replay.SetChallengeManager(m)
+		replay.ProcessNegotiateMessage(negotiate)
+		replay.GenerateChallengeMessage()
+		replay.SetServerChallenge(challenge.ServerChallenge)
+		authenticate, _ = messages.ParseAuthenticateMessage(authenticateBytes)
+		if err := replay.ProcessAuthenticateMessage(authenticate); err != ErrChallengeUnknown {
+			t.Errorf("NTLMv%d: Expected ErrChallengeUnknown for a replayed authenticate message but got %v", version, err)
+		}
+	}
+}
+
+func TestChallengeManagerBindsChallengeToSession(t *testing.T) {
+	m := NewChallengeManager(time.Minute)
+	for _, version := range []Version{Version1, Version2} {
+		client := newTestClient(t, version, ConnectionOrientedMode)
+		negotiate, _ := client.GenerateNegotiateMessage()
+		other, _ := CreateServerSession(version, ConnectionOrientedMode)
+		other.SetChallengeManager(m)
+		other.ProcessNegotiateMessage(negotiate)
+		otherChallenge, _ := other.GenerateChallengeMessage()
+
+		// A session can not take over the challenge issued to another session that has not used it yet
+		server := newTestServer(t, version, ConnectionOrientedMode)
+		server.SetChallengeManager(m)
+		server.ProcessNegotiateMessage(negotiate)
+		server.GenerateChallengeMessage()
+		server.SetServerChallenge(otherChallenge.ServerChallenge)
+		client.ProcessChallengeMessage(otherChallenge)
+		authenticate, _ := client.GenerateAuthenticateMessage()
+		authenticate, _ = messages.ParseAuthenticateMessage(authenticate.Bytes())
+		if err := server.ProcessAuthenticateMessage(authenticate); err != ErrChallengeUnknown {
+			t.Errorf("NTLMv%d: Expected ErrChallengeUnknown for the challenge of another session but got %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"ntlm/messages"
+)
+
+type ChannelBindingPolicy int
+
+const (
+	// Channel bindings sent by the client are ignored
+	ChannelBindingOff ChannelBindingPolicy = iota
+	// Channel bindings are checked when the client sends them, clients that do not are still accepted
+	ChannelBindingWhenSupported
+	// The client must send channel bindings that match, NTLMv1 clients can not do this
+	ChannelBindingRequired
+)
+
+// Returned when the channel bindings of the client are missing or do not match those of the server
+var ErrChannelBindings = newAuthenticationError("Channel bindings do not match")
+
+// The tls-server-end-point channel binding application data (RFC 5929) for the certificate of a TLS server, the hash
+// of the certificate uses the signature hash of the certificate, with SHA-256 used instead of MD5 and SHA-1
+func TLSServerEndPointBindings(cert *x509.Certificate) []byte {
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	default:
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+	return concat([]byte("tls-server-end-point:"), h.Sum(nil))
+}
+
+// The MsvChannelBindings value: the MD5 hash of a gss_channel_bindings_struct (RFC 2744) that only carries the
+// application data, the initiator and acceptor addresses are empty
+func ChannelBindingsHash(applicationData []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, 20+len(applicationData)))
+	// initiator_addrtype and initiator_address
+	binary.Write(buffer, binary.LittleEndian, uint32(0))
+	binary.Write(buffer, binary.LittleEndian, uint32(0))
+	// acceptor_addrtype and acceptor_address
+	binary.Write(buffer, binary.LittleEndian, uint32(0))
+	binary.Write(buffer, binary.LittleEndian, uint32(0))
+	// application_data
+	binary.Write(buffer, binary.LittleEndian, uint32(len(applicationData)))
+	buffer.Write(applicationData)
+	return md5(buffer.Bytes())
+}
+
+// Set the channel binding application data of the secure channel the NTLM messages are sent over, for TLS this
+// is usually TLSServerEndPointBindings of the server certificate. A client sends the hash in its NTLMv2 response, a
+// server compares it according to its ChannelBindingPolicy.
+func (n *SessionData) SetChannelBindings(applicationData []byte) {
+	n.channelBindings = ChannelBindingsHash(applicationData)
+}
+
+// Set how a server checks the channel bindings of the client, ChannelBindingOff by default
+func (n *SessionData) SetChannelBindingPolicy(policy ChannelBindingPolicy) {
+	n.channelBindingPolicy = policy
+}
+
+// Check the MsvChannelBindings sent by the client against the channel bindings of the server, pairs is nil for
+// NTLMv1 responses. An all zero hash means the client has no channel bindings.
+func (n *SessionData) verifyChannelBindings(pairs *messages.AvPairs) error {
+	if n.channelBindingPolicy == ChannelBindingOff {
+		return nil
+	}
+
+	var clientBindings []byte
+	if pairs != nil {
+		clientBindings = pairs.ByteValue(messages.MsvChannelBindings)
+	}
+	if len(clientBindings) == 0 || bytes.Equal(clientBindings, zeroBytes(16)) {
+		if n.channelBindingPolicy == ChannelBindingRequired {
+			return ErrChannelBindings
+		}
+		return nil
+	}
+
+	if !bytes.Equal(clientBindings, n.channelBindings) {
+		return ErrChannelBindings
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"ntlm/messages"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "web01.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestChannelBindingsHash(t *testing.T) {
+	cert := testCertificate(t)
+	hash := sha256.Sum256(cert.Raw)
+	bindings := TLSServerEndPointBindings(cert)
+	if !bytes.Equal(bindings, append([]byte("tls-server-end-point:"), hash[:]...)) {
+		t.Errorf("Wrong tls-server-end-point bindings %s", hex.EncodeToString(bindings))
+	}
+
+	// gss_channel_bindings_struct with empty addresses and the application data "abc"
+	expected := md5(append(append(make([]byte, 16), 3, 0, 0, 0), []byte("abc")...))
+	checkV2Value(t, "ChannelBindingsHash", ChannelBindingsHash([]byte("abc")), hex.EncodeToString(expected), nil)
+}
+
+// Run a handshake with channel bindings on client and server, nil bindings are not set
+func authenticateWithBindings(t *testing.T, version Version, clientBindings, serverBindings []byte, policy ChannelBindingPolicy) error {
+	client, server := newTestSessions(t, version, ConnectionOrientedMode)
+	server.SetChannelBindingPolicy(policy)
+	if serverBindings != nil {
+		server.SetChannelBindings(serverBindings)
+	}
+	if clientBindings != nil {
+		client.SetChannelBindings(clientBindings)
+	}
+
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	client.ProcessChallengeMessage(challenge)
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticate, _ = messages.ParseAuthenticateMessage(authenticate.Bytes())
+	return server.ProcessAuthenticateMessage(authenticate)
+}
+
+func TestChannelBindingPolicy(t *testing.T) {
+	bindings := TLSServerEndPointBindings(testCertificate(t))
+	other := TLSServerEndPointBindings(testCertificate(t))
+
+	if err := authenticateWithBindings(t, Version2, bindings, bindings, ChannelBindingRequired); err != nil {
+		t.Errorf("Matching channel bindings were not accepted: %s", err)
+	}
+	if err := authenticateWithBindings(t, Version2, other, bindings, ChannelBindingWhenSupported); err != ErrChannelBindings {
+		t.Errorf("Expected ErrChannelBindings for different channel bindings but got %v", err)
+	}
+	if err := authenticateWithBindings(t, Version2, nil, bindings, ChannelBindingWhenSupported); err != nil {
+		t.Errorf("Client without channel bindings was not accepted: %s", err)
+	}
+	if err := authenticateWithBindings(t, Version2, nil, bindings, ChannelBindingRequired); err != ErrChannelBindings {
+		t.Errorf("Expected ErrChannelBindings for a client without channel bindings but got %v", err)
+	}
+	if err := authenticateWithBindings(t, Version2, other, bindings, ChannelBindingOff); err != nil {
+		t.Errorf("Channel bindings should be ignored: %s", err)
+	}
+	if err := authenticateWithBindings(t, Version1, bindings, bindings, ChannelBindingRequired); err != ErrChannelBindings {
+		t.Errorf("Expected ErrChannelBindings for an NTLMv1 client but got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"os"
+)
+
+// The identity a client sends in the NEGOTIATE_MESSAGE and AUTHENTICATE_MESSAGE
+type ClientInfo struct {
+	// The name of the client machine, servers usually record it in their audit logs
+	Workstation string
+
+	// The version advertised when NTLMSSP_NEGOTIATE_VERSION is negotiated. NTLMRevisionCurrent should be 15 (0x0F),
+	// zero is replaced with 15.
+	Version *messages.VersionStruct
+}
+
+// The client info used when SetClientInfo is not called, the workstation is the NetBIOS name of the machine
+func DefaultClientInfo() *ClientInfo {
+	info := new(ClientInfo)
+	hostname, _ := os.Hostname()
+	info.Workstation = netbiosName(hostname)
+	info.Version = defaultVersion()
+	return info
+}
+
+// Set the workstation name and version the client sends, a missing version is taken from DefaultClientInfo. The
+// workstation may be empty in which case it is not sent.
+func (n *SessionData) SetClientInfo(info ClientInfo) {
+	if info.Version == nil {
+		info.Version = defaultVersion()
+	} else if info.Version.NTLMRevisionCurrent == 0 {
+		version := *info.Version
+		version.NTLMRevisionCurrent = uint8(15)
+		info.Version = &version
+	}
+	n.clientInfo = &info
+}
+
+// The client info of the session, DefaultClientInfo when none was set
+func (n *SessionData) getClientInfo() *ClientInfo {
+	if n.clientInfo == nil {
+		n.clientInfo = DefaultClientInfo()
+	}
+	return n.clientInfo
+}
+
+// The workstation the client sent in the authenticate message, empty before one has been processed
+func (n *SessionData) GetWorkstation() string {
+	if n.authenticateMessage == nil || n.authenticateMessage.Workstation == nil {
+		return ""
+	}
+	return n.payloadString(n.authenticateMessage.Workstation)
+}
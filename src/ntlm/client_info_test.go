@@ -0,0 +1,49 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"os"
+	"testing"
+)
+
+func TestClientInfo(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	client.SetClientInfo(ClientInfo{Workstation: "LAPTOP42", Version: &messages.VersionStruct{ProductMajorVersion: 10, ProductBuild: 19041}})
+
+	negotiate, _ := client.GenerateNegotiateMessage()
+	negotiate, err := messages.ParseNegotiateMessage(negotiate.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse negotiate message: %s", err)
+	}
+	if !messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.IsSet(negotiate.NegotiateFlags) || negotiate.WorkstationFields.String() != "LAPTOP42" {
+		t.Errorf("Negotiate message should supply the workstation LAPTOP42 but was %s", negotiate.WorkstationFields.String())
+	}
+
+	runHandshake(t, client, server)
+	authenticate := server.GetSessionData().authenticateMessage
+	if authenticate.Workstation.String() != "LAPTOP42" || server.GetWorkstation() != "LAPTOP42" {
+		t.Errorf("Authenticate message should contain the workstation LAPTOP42 but was %s", authenticate.Workstation.String())
+	}
+	if authenticate.Version.ProductBuild != 19041 || authenticate.Version.NTLMRevisionCurrent != 15 {
+		t.Errorf("Authenticate message has the wrong version %s", authenticate.Version.String())
+	}
+}
+
+func TestDefaultClientInfo(t *testing.T) {
+	hostname, _ := os.Hostname()
+	if DefaultClientInfo().Workstation != netbiosName(hostname) {
+		t.Errorf("Default workstation should be the hostname but was %s", DefaultClientInfo().Workstation)
+	}
+	if netbiosName("averyveryverylonghostname.example.com") != "AVERYVERYVERYLO" {
+		t.Errorf("NetBIOS name was not truncated: %s", netbiosName("averyveryverylonghostname.example.com"))
+	}
+
+	// Without NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED the workstation is not sent in the negotiate message
+	client, _ := CreateClientSession(Version1, ConnectionOrientedMode)
+	client.SetSupportedFlags(client.(*V1ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED))
+	negotiate, _ := client.GenerateNegotiateMessage()
+	if negotiate.WorkstationFields.Len != 0 {
+		t.Errorf("Negotiate message should not supply the workstation but was %s", negotiate.WorkstationFields.String())
+	}
+}
@@ -0,0 +1,152 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// The secret of a user, either the password or the NT hash of the password (MD4 of the UTF-16 password). The NT hash is
+// used when it is set, the LM hash is optional and only needed for the LM response and LM session key of NTLMv1.
+type Credential struct {
+	Password string
+	NtHash   []byte
+	LmHash   []byte
+}
+
+// Returned when a credential has an NT or LM hash that is not 16 bytes long
+var ErrInvalidCredential = errors.New("NT and LM hashes must be 16 bytes")
+
+// The hashes are 16 bytes, the LM hash may also be left out
+func (c *Credential) check() error {
+	if c == nil {
+		return nil
+	}
+	if c.NtHash != nil && len(c.NtHash) != 16 || c.LmHash != nil && len(c.LmHash) != 16 {
+		return ErrInvalidCredential
+	}
+	return nil
+}
+
+// Returns the NT hash of the credential
+func (c *Credential) ntHash() []byte {
+	if c.NtHash != nil {
+		return c.NtHash
+	}
+	return ntowfv1(c.Password)
+}
+
+// Returns the LM hash of the credential, nil when it can not be computed because only the NT hash is known
+func (c *Credential) lmHash() ([]byte, error) {
+	if c.LmHash != nil {
+		return c.LmHash, nil
+	}
+	if c.NtHash != nil {
+		return nil, nil
+	}
+	return lmowfv1(c.Password)
+}
+
+// A CredentialStore is consulted by a server session to find the credential of the user named in the AUTHENTICATE_MESSAGE.
+// Usually this would be backed by a directory, NewMemoryCredentialStore returns a simple in memory implementation.
+type CredentialStore interface {
+	// Returns the credential of the user in the domain, or an error when the user is not known
+	GetCredential(user string, domain string) (*Credential, error)
+}
+
+// A CredentialStore that keeps the credentials in memory, it is safe for concurrent use. User and domain names are
+// case insensitive, credentials added with an empty domain match any domain the client sends.
+type MemoryCredentialStore struct {
+	mutex       sync.RWMutex
+	credentials map[string]*Credential
+}
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{credentials: make(map[string]*Credential)}
+}
+
+func credentialKey(user string, domain string) string {
+	return strings.ToUpper(domain) + "\\" + strings.ToUpper(user)
+}
+
+// Add or replace the credential of a user, ErrInvalidCredential is returned for hashes that are not 16 bytes
+func (s *MemoryCredentialStore) AddCredential(user string, domain string, credential *Credential) error {
+	err := credential.check()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.credentials[credentialKey(user, domain)] = credential
+	return nil
+}
+
+func (s *MemoryCredentialStore) AddPassword(user string, domain string, password string) {
+	s.AddCredential(user, domain, &Credential{Password: password})
+}
+
+func (s *MemoryCredentialStore) AddNtHash(user string, domain string, ntHash []byte) error {
+	return s.AddCredential(user, domain, &Credential{NtHash: ntHash})
+}
+
+func (s *MemoryCredentialStore) RemoveCredential(user string, domain string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.credentials, credentialKey(user, domain))
+}
+
+func (s *MemoryCredentialStore) GetCredential(user string, domain string) (*Credential, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if credential, ok := s.credentials[credentialKey(user, domain)]; ok {
+		return credential, nil
+	}
+	if credential, ok := s.credentials[credentialKey(user, "")]; ok {
+		return credential, nil
+	}
+	return nil, newAuthenticationError("Unknown user " + user + " in domain " + domain)
+}
+
+// Set the store a server session uses to look up the credential of the user that is authenticating. Without a store
+// the password given to SetUserInfo is used.
+func (n *SessionData) SetCredentialStore(store CredentialStore) {
+	n.credentialStore = store
+}
+
+// Set the user with the NT hash of the password instead of the password itself, the password never has to be kept
+func (n *SessionData) SetUserHash(username string, ntHash []byte, domain string) error {
+	return n.SetUserCredential(username, &Credential{NtHash: ntHash}, domain)
+}
+
+// Set the user with a credential, this allows both the NT and the LM hash to be given. ErrInvalidCredential is returned
+// for hashes that are not 16 bytes and the session is left unchanged.
+func (n *SessionData) SetUserCredential(username string, credential *Credential, domain string) error {
+	err := credential.check()
+	if err != nil {
+		return err
+	}
+	n.user = username
+	n.password = ""
+	n.userDomain = domain
+	n.credential = credential
+	return nil
+}
+
+// The credential of the session user, from the credential store when there is one
+func (n *SessionData) fetchCredential() (*Credential, error) {
+	if n.credentialStore == nil {
+		if n.credential != nil {
+			return n.credential, nil
+		}
+		return &Credential{Password: n.password}, nil
+	}
+	credential, err := n.credentialStore.GetCredential(n.user, n.userDomain)
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil {
+		return nil, newAuthenticationError("Unknown user " + n.user + " in domain " + n.userDomain)
+	}
+	return credential, credential.check()
+}
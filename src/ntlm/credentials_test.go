@@ -0,0 +1,119 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"encoding/hex"
+	"ntlm/messages"
+	"testing"
+)
+
+// Run a handshake and return the error of the server processing the authenticate message
+func authenticateWithStore(t *testing.T, version Version, store CredentialStore, user, password, domain string) error {
+	server, _ := CreateServerSession(version, ConnectionOrientedMode)
+	server.SetCredentialStore(store)
+	client, _ := CreateClientSession(version, ConnectionOrientedMode)
+	client.SetUserInfo(user, password, domain)
+
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	err := client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticate, err = messages.ParseAuthenticateMessage(authenticate.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	return server.ProcessAuthenticateMessage(authenticate)
+}
+
+func TestCredentialStore(t *testing.T) {
+	store := NewMemoryCredentialStore()
+	store.AddPassword("alice", "EXAMPLE", "Alice's password")
+	store.AddNtHash("bob", "EXAMPLE", ntowfv1("Bob's password"))
+	store.AddPassword("carol", "", "Carol's password")
+
+	for _, version := range []Version{Version1, Version2} {
+		if err := authenticateWithStore(t, version, store, "Alice", "Alice's password", "example"); err != nil {
+			t.Errorf("NTLMv%d: Could not authenticate alice: %s", version, err)
+		}
+		if err := authenticateWithStore(t, version, store, "bob", "Bob's password", "EXAMPLE"); err != nil {
+			t.Errorf("NTLMv%d: Could not authenticate bob with a stored NT hash: %s", version, err)
+		}
+		if err := authenticateWithStore(t, version, store, "carol", "Carol's password", "OTHER"); err != nil {
+			t.Errorf("NTLMv%d: Could not authenticate carol in any domain: %s", version, err)
+		}
+		if err := authenticateWithStore(t, version, store, "alice", "Bob's password", "EXAMPLE"); err == nil {
+			t.Errorf("NTLMv%d: Authenticated alice with the wrong password", version)
+		}
+		if err := authenticateWithStore(t, version, store, "alice", "Alice's password", "OTHER"); err == nil {
+			t.Errorf("NTLMv%d: Authenticated alice in the wrong domain", version)
+		}
+		if err := authenticateWithStore(t, version, store, "dave", "Dave's password", "EXAMPLE"); err == nil {
+			t.Errorf("NTLMv%d: Authenticated an unknown user", version)
+		}
+	}
+
+	store.RemoveCredential("ALICE", "example")
+	if _, err := store.GetCredential("alice", "EXAMPLE"); err == nil {
+		t.Error("Removed credential was still returned")
+	}
+}
+
+func TestSetUserHash(t *testing.T) {
+	ntHash := ntowfv1("Password")
+	lmHash, _ := lmowfv1("Password")
+
+	for _, version := range []Version{Version1, Version2} {
+		// Client with the NT hash, server with the password
+		server := newTestServer(t, version, ConnectionOrientedMode)
+		client, _ := CreateClientSession(version, ConnectionOrientedMode)
+		client.SetUserHash("User", ntHash, "Domain")
+		runHandshake(t, client, server)
+
+		// Server with the NT hash, client with the password
+		server, _ = CreateServerSession(version, ConnectionOrientedMode)
+		server.SetUserHash("User", ntHash, "Domain")
+		runHandshake(t, newTestClient(t, version, ConnectionOrientedMode), server)
+	}
+
+	// NTLMv1 without extended session security uses the LM hash for the LM response
+	server, _ := CreateServerSession(Version1, ConnectionOrientedMode)
+	server.SetUserCredential("User", &Credential{NtHash: ntHash, LmHash: lmHash}, "Domain")
+	client, _ := CreateClientSession(Version1, ConnectionOrientedMode)
+	client.SetSupportedFlags(client.(*V1ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY))
+	client.SetUserCredential("User", &Credential{NtHash: ntHash, LmHash: lmHash}, "Domain")
+	runHandshake(t, client, server)
+	expected, _ := desL(lmHash, server.GetSessionData().serverChallenge)
+	checkV1Value(t, "LMChallengeResponse", server.GetSessionData().authenticateMessage.LmChallengeResponse.Payload, hex.EncodeToString(expected), nil)
+
+	// The password set later replaces the hash
+	client.SetUserHash("User", ntowfv1("Wrong"), "Domain")
+	client.SetUserInfo("User", "Password", "Domain")
+	if credential, _ := client.(*V1ClientSession).fetchCredential(); credential.NtHash != nil {
+		t.Error("SetUserInfo did not replace the NT hash")
+	}
+}
+
+func TestInvalidCredential(t *testing.T) {
+	client, _ := CreateClientSession(Version2, ConnectionOrientedMode)
+	if err := client.SetUserHash("User", []byte("short"), "Domain"); err != ErrInvalidCredential {
+		t.Errorf("Expected ErrInvalidCredential for a short NT hash but got %v", err)
+	}
+	if err := client.SetUserCredential("User", &Credential{NtHash: ntowfv1("Password"), LmHash: make([]byte, 8)}, "Domain"); err != ErrInvalidCredential {
+		t.Errorf("Expected ErrInvalidCredential for a short LM hash but got %v", err)
+	}
+	if user, _, _ := client.(*V2ClientSession).GetUserInfo(); user != "" {
+		t.Error("An invalid credential changed the user of the session")
+	}
+
+	store := NewMemoryCredentialStore()
+	if err := store.AddNtHash("User", "Domain", make([]byte, 20)); err != ErrInvalidCredential {
+		t.Errorf("Expected ErrInvalidCredential for a long NT hash but got %v", err)
+	}
+	if _, err := store.GetCredential("User", "Domain"); err == nil {
+		t.Error("An invalid credential was stored")
+	}
+}
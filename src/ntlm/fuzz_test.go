@@ -0,0 +1,78 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+)
+
+var fuzzServerChallenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+// A server session that expects an authenticate message for fuzzServerChallenge
+func fuzzServer() ServerSession {
+	server, _ := CreateServerSession(VersionAuto, ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain")
+	server.SetAllowAnonymous(true)
+	server.GenerateChallengeMessage()
+	server.SetServerChallenge(fuzzServerChallenge)
+	return server
+}
+
+// The messages of handshakes with clients of both versions, and of an anonymous client, as the seed corpus
+func addHandshakeSeeds(f *testing.F, authenticate bool) {
+	for _, version := range []Version{Version1, Version2} {
+		for _, user := range []string{"User", ""} {
+			client, _ := CreateClientSession(version, ConnectionOrientedMode)
+			if user != "" {
+				client.SetUserInfo(user, "Password", "Domain")
+			}
+			server := fuzzServer()
+			challenge, _ := server.GenerateChallengeMessage()
+			challenge.ServerChallenge = fuzzServerChallenge
+			if !authenticate {
+				f.Add(challenge.Bytes())
+				continue
+			}
+			client.GenerateNegotiateMessage()
+			if err := client.ProcessChallengeMessage(challenge); err != nil {
+				f.Fatal(err)
+			}
+			am, _ := client.GenerateAuthenticateMessage()
+			f.Add(am.Bytes())
+		}
+	}
+}
+
+func FuzzServerProcessAuthenticateMessage(f *testing.F) {
+	addHandshakeSeeds(f, true)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		am, err := messages.ParseAuthenticateMessage(data)
+		if err != nil {
+			return
+		}
+		server := fuzzServer()
+		if server.ProcessAuthenticateMessage(am) == nil {
+			server.Seal([]byte("message"), 0)
+		}
+	})
+}
+
+func FuzzClientProcessChallengeMessage(f *testing.F) {
+	addHandshakeSeeds(f, false)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cm, err := messages.ParseChallengeMessage(data)
+		if err != nil {
+			return
+		}
+		for _, version := range []Version{Version1, Version2} {
+			client, _ := CreateClientSession(version, ConnectionOrientedMode)
+			client.SetUserInfo("User", "Password", "Domain")
+			client.GenerateNegotiateMessage()
+			if client.ProcessChallengeMessage(cm) == nil {
+				client.GenerateAuthenticateMessage()
+			}
+		}
+	})
+}
@@ -32,3 +32,26 @@ func TestMacsEqualsFail(t *testing.T) {
 		t.Errorf("Expected MacsEqual(%v, %v) to be false", firstSlice, secondSlice)
 	}
 }
+
+// A client and a server session of the version, both for User, Password and Domain
+func newTestSessions(t *testing.T, version Version, mode Mode) (ClientSession, ServerSession) {
+	return newTestClient(t, version, mode), newTestServer(t, version, mode)
+}
+
+func newTestClient(t *testing.T, version Version, mode Mode) ClientSession {
+	client, err := CreateClientSession(version, mode)
+	if err != nil {
+		t.Fatalf("Could not create client session: %s", err)
+	}
+	client.SetUserInfo("User", "Password", "Domain")
+	return client
+}
+
+func newTestServer(t *testing.T, version Version, mode Mode) ServerSession {
+	server, err := CreateServerSession(version, mode)
+	if err != nil {
+		t.Fatalf("Could not create server session: %s", err)
+	}
+	server.SetUserInfo("User", "Password", "Domain")
+	return server
+}
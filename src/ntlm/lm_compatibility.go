@@ -0,0 +1,83 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+)
+
+// The security policy of the Windows LmCompatibilityLevel setting, it controls the responses a client sends and the
+// responses a server accepts
+type LmCompatibilityLevel int
+
+const (
+	// Clients send LM and NTLMv1 responses and never use extended session security
+	LmCompatibilityLevel0 LmCompatibilityLevel = iota
+	// Clients send LM and NTLMv1 responses and use extended session security when the server supports it
+	LmCompatibilityLevel1
+	// Clients send the NTLMv1 response only, the LM response is a copy of it
+	LmCompatibilityLevel2
+	// Clients send NTLMv2 responses only
+	LmCompatibilityLevel3
+	// Clients send NTLMv2 responses only, servers refuse LM responses
+	LmCompatibilityLevel4
+	// Clients send NTLMv2 responses only, servers refuse LM and NTLMv1 responses
+	LmCompatibilityLevel5
+)
+
+// Returned when a session is used for a response type the LmCompatibilityLevel does not allow. A server that refuses
+// the response of a client has not authenticated it so the error matches ErrAuthenticationFailed.
+var ErrLmCompatibilityLevel = newAuthenticationError("Response type is not allowed by the LmCompatibilityLevel")
+
+// The NTLM version a client at this level uses
+func (l LmCompatibilityLevel) ClientVersion() Version {
+	if l >= LmCompatibilityLevel3 {
+		return Version2
+	}
+	return Version1
+}
+
+// Creates a client session of the NTLM version that the level sends, with the level set on the session
+func CreateClientSessionForLevel(level LmCompatibilityLevel, mode Mode) (n ClientSession, err error) {
+	n, err = CreateClientSession(level.ClientVersion(), mode)
+	if err != nil {
+		return nil, err
+	}
+	n.SetLmCompatibilityLevel(level)
+	return n, nil
+}
+
+// Set the LmCompatibilityLevel of the session. Without a level the session sends and accepts the responses of its
+// NTLM version, as it did before the level was introduced.
+func (n *SessionData) SetLmCompatibilityLevel(level LmCompatibilityLevel) {
+	n.lmCompatibilityLevel = &level
+}
+
+// A client may only send the responses of the NTLM version of its level
+func (n *SessionData) checkClientVersion(version Version) error {
+	if n.lmCompatibilityLevel != nil && n.lmCompatibilityLevel.ClientVersion() != version {
+		return ErrLmCompatibilityLevel
+	}
+	return nil
+}
+
+// Adjust the flags an NTLMv1 client offers, extended session security is not used at level 0
+func (n *SessionData) clientLevelFlags(flags uint32) uint32 {
+	if n.lmCompatibilityLevel != nil && *n.lmCompatibilityLevel == LmCompatibilityLevel0 {
+		flags = messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Unset(flags)
+	}
+	return flags
+}
+
+// From level 2 the NTLMv1 response is sent in place of the LM response
+func (n *SessionData) noLmResponse() bool {
+	return n.lmCompatibilityLevel != nil && *n.lmCompatibilityLevel >= LmCompatibilityLevel2
+}
+
+// A server refuses LM responses from level 4 and NTLMv1 responses at level 5
+func (n *SessionData) refusesLmResponse() bool {
+	return n.lmCompatibilityLevel != nil && *n.lmCompatibilityLevel >= LmCompatibilityLevel4
+}
+
+func (n *SessionData) refusesNtlmV1Response() bool {
+	return n.lmCompatibilityLevel != nil && *n.lmCompatibilityLevel >= LmCompatibilityLevel5
+}
@@ -0,0 +1,74 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"bytes"
+	"errors"
+	"ntlm/messages"
+	"testing"
+)
+
+func TestLmCompatibilityLevelClient(t *testing.T) {
+	for level := LmCompatibilityLevel0; level <= LmCompatibilityLevel5; level++ {
+		client, _ := CreateClientSessionForLevel(level, ConnectionOrientedMode)
+		client.SetUserInfo("User", "Password", "Domain")
+		server := newTestServer(t, level.ClientVersion(), ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(level)
+		runHandshake(t, client, server)
+
+		data := server.GetSessionData()
+		ess := messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(data.authenticateMessage.NegotiateFlags)
+		if level == LmCompatibilityLevel0 && ess {
+			t.Error("Level 0 should not use extended session security")
+		}
+		if (level == LmCompatibilityLevel1 || level == LmCompatibilityLevel2) && !ess {
+			t.Errorf("Level %d should use extended session security", level)
+		}
+		if level >= LmCompatibilityLevel3 && data.authenticateMessage.NtlmV2Response == nil {
+			t.Errorf("Level %d should send an NTLMv2 response", level)
+		}
+	}
+
+	// Without extended session security level 2 sends the NTLMv1 response in place of the LM response
+	client, _ := CreateClientSessionForLevel(LmCompatibilityLevel2, ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain")
+	client.SetSupportedFlags(client.(*V1ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY))
+	server := newTestServer(t, Version1, ConnectionOrientedMode)
+	runHandshake(t, client, server)
+	authenticate := server.GetSessionData().authenticateMessage
+	if !bytes.Equal(authenticate.LmChallengeResponse.Payload, authenticate.NtChallengeResponseFields.Payload) {
+		t.Error("Level 2 should send the NTLMv1 response as the LM response")
+	}
+
+	// An NTLMv1 session can not be used at a level that only sends NTLMv2
+	v1, _ := CreateClientSession(Version1, ConnectionOrientedMode)
+	v1.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+	if _, err := v1.GenerateNegotiateMessage(); err != ErrLmCompatibilityLevel {
+		t.Errorf("Expected ErrLmCompatibilityLevel but got %v", err)
+	}
+}
+
+func TestLmCompatibilityLevelServer(t *testing.T) {
+	client, server := newTestSessions(t, Version1, ConnectionOrientedMode)
+	server.SetLmCompatibilityLevel(LmCompatibilityLevel5)
+	if err := handshakeError(client, server); err != ErrLmCompatibilityLevel {
+		t.Errorf("Expected ErrLmCompatibilityLevel for an NTLMv1 response at level 5 but got %v", err)
+	}
+
+	// A client with the right LM hash but the wrong NT hash only gets past the response check when LM is accepted,
+	// it then fails on the MIC
+	lmHash, _ := lmowfv1("Password")
+	for _, level := range []LmCompatibilityLevel{LmCompatibilityLevel3, LmCompatibilityLevel4} {
+		client, server = newTestSessions(t, Version1, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(level)
+		client.SetSupportedFlags(client.(*V1ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY))
+		client.SetUserCredential("User", &Credential{NtHash: ntowfv1("Wrong"), LmHash: lmHash}, "Domain")
+		err := handshakeError(client, server)
+		if level == LmCompatibilityLevel3 && !errors.Is(err, ErrInvalidMic) {
+			t.Errorf("Level 3 should accept the LM response but got %v", err)
+		}
+		if level == LmCompatibilityLevel4 && (!errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrInvalidMic)) {
+			t.Errorf("Level 4 should refuse the LM response but got %v", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"fmt"
+	"ntlm/messages"
+	"sync"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarning:
+		return "WARNING"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// The events a session logs
+const (
+	// A server received the negotiate message, the fields are flags, domain and workstation
+	EventNegotiateReceived = "negotiate_received"
+	// A server sent a challenge message, the field is flags
+	EventChallengeIssued = "challenge_issued"
+	// A server authenticated the client, the fields are user, domain, workstation, version and anonymous
+	EventAuthenticationSucceeded = "authentication_succeeded"
+	// A server rejected the client, the fields are user, domain, workstation, version and reason
+	EventAuthenticationFailed = "authentication_failed"
+	// The signing and sealing keys were derived, logged at LogDebug. The fields are flags, extended_session_security
+	// and key_exchange, the keys themselves are never logged.
+	EventKeysDerived = "keys_derived"
+)
+
+// Receives the events of sessions. The fields are pairs of a name and a value, the names are listed with the events.
+type Logger interface {
+	Log(level LogLevel, event string, fields ...interface{})
+}
+
+// Use a function as a Logger
+type LoggerFunc func(level LogLevel, event string, fields ...interface{})
+
+func (f LoggerFunc) Log(level LogLevel, event string, fields ...interface{}) {
+	f(level, event, fields...)
+}
+
+var (
+	defaultLoggerMutex sync.RWMutex
+	defaultLogger      Logger
+)
+
+// Set the logger used by sessions that do not have their own, nil (the default) discards the events
+func SetDefaultLogger(logger Logger) {
+	defaultLoggerMutex.Lock()
+	defer defaultLoggerMutex.Unlock()
+	defaultLogger = logger
+}
+
+// Set the logger of the session, it is used instead of the default logger
+func (n *SessionData) SetLogger(logger Logger) {
+	n.logger = logger
+}
+
+func (n *SessionData) log(level LogLevel, event string, fields ...interface{}) {
+	logger := n.logger
+	if logger == nil {
+		defaultLoggerMutex.RLock()
+		logger = defaultLogger
+		defaultLoggerMutex.RUnlock()
+	}
+	if logger != nil {
+		logger.Log(level, event, fields...)
+	}
+}
+
+func formatFlags(flags uint32) string {
+	return fmt.Sprintf("0x%08x", flags)
+}
+
+// The string value of a payload that may not be present
+func payloadString(p *messages.PayloadStruct) string {
+	if p == nil {
+		return ""
+	}
+	return p.String()
+}
+
+func (n *SessionData) logNegotiateReceived(nm *messages.Negotiate) {
+	n.log(LogInfo, EventNegotiateReceived, "flags", formatFlags(nm.NegotiateFlags), "domain", payloadString(nm.DomainNameFields), "workstation", payloadString(nm.WorkstationFields))
+}
+
+func (n *SessionData) logChallengeIssued(cm *messages.Challenge) {
+	n.log(LogInfo, EventChallengeIssued, "flags", formatFlags(cm.NegotiateFlags))
+}
+
+// Log the outcome of processing an authenticate message of the given NTLM version
+func (n *SessionData) logAuthenticateResult(version int, err error) {
+	workstation := n.GetWorkstation()
+	if err != nil {
+		n.log(LogWarning, EventAuthenticationFailed, "user", n.user, "domain", n.userDomain, "workstation", workstation, "version", version, "reason", err.Error())
+		return
+	}
+	n.log(LogInfo, EventAuthenticationSucceeded, "user", n.user, "domain", n.userDomain, "workstation", workstation, "version", version, "anonymous", n.anonymous)
+}
+
+func (n *SessionData) logKeysDerived() {
+	n.log(LogDebug, EventKeysDerived, "flags", formatFlags(n.NegotiateFlags),
+		"extended_session_security", messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags),
+		"key_exchange", messages.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags))
+}
@@ -0,0 +1,87 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type loggedEvent struct {
+	level  LogLevel
+	event  string
+	fields map[string]interface{}
+}
+
+// A logger that keeps the events it receives
+type recordingLogger struct {
+	mutex  sync.Mutex
+	events []loggedEvent
+}
+
+func (r *recordingLogger) Log(level LogLevel, event string, fields ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	e := loggedEvent{level: level, event: event, fields: make(map[string]interface{})}
+	for i := 0; i+1 < len(fields); i += 2 {
+		e.fields[fields[i].(string)] = fields[i+1]
+	}
+	r.events = append(r.events, e)
+}
+
+func (r *recordingLogger) names() string {
+	names := make([]string, 0, len(r.events))
+	for _, e := range r.events {
+		names = append(names, e.event)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestLogger(t *testing.T) {
+	serverLog := new(recordingLogger)
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	client.SetClientInfo(ClientInfo{Workstation: "WS01"})
+	server.SetLogger(serverLog)
+	runHandshake(t, client, server)
+
+	expected := EventNegotiateReceived + "," + EventChallengeIssued + "," + EventKeysDerived + "," + EventAuthenticationSucceeded
+	if serverLog.names() != expected {
+		t.Fatalf("Expected the events %s but got %s", expected, serverLog.names())
+	}
+	if serverLog.events[2].level != LogDebug {
+		t.Errorf("Key derivation should be logged at LogDebug but was %s", serverLog.events[2].level)
+	}
+	success := serverLog.events[3]
+	if success.level != LogInfo || success.fields["user"] != "User" || success.fields["domain"] != "Domain" || success.fields["workstation"] != "WS01" || success.fields["version"] != 2 {
+		t.Errorf("Unexpected authentication event %v", success)
+	}
+	for _, e := range serverLog.events {
+		if strings.Contains(fmt.Sprint(e.fields), "Password") {
+			t.Errorf("Event %s contains the password", e.event)
+		}
+	}
+
+	// The reason of a failure is logged, the events of the client go to the default logger
+	defaultLog := new(recordingLogger)
+	SetDefaultLogger(defaultLog)
+	defer SetDefaultLogger(nil)
+	serverLog = new(recordingLogger)
+	client = newTestClient(t, Version1, ConnectionOrientedMode)
+	client.SetUserInfo("User", "Wrong password", "Domain")
+	server = newTestServer(t, VersionAuto, ConnectionOrientedMode)
+	server.SetLogger(serverLog)
+	handshakeError(client, server)
+
+	expected = EventNegotiateReceived + "," + EventChallengeIssued + "," + EventAuthenticationFailed
+	if serverLog.names() != expected {
+		t.Fatalf("Expected the events %s but got %s", expected, serverLog.names())
+	}
+	failure := serverLog.events[2]
+	if failure.level != LogWarning || failure.fields["reason"] == "" || failure.fields["version"] != 1 {
+		t.Errorf("Unexpected authentication event %v", failure)
+	}
+	if defaultLog.names() != EventKeysDerived {
+		t.Errorf("Expected the client to log %s to the default logger but got %s", EventKeysDerived, defaultLog.names())
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
 type Authenticate struct {
+	// All bytes of the message as they were parsed, used when computing the MIC
+	RawBytes []byte
+
 	// sig - 8 bytes
 	Signature []byte
 	// message type - 4 bytes
@@ -47,66 +49,93 @@ type Authenticate struct {
 
 	// The message integrity for the NTLM NEGOTIATE_MESSAGE, CHALLENGE_MESSAGE, and AUTHENTICATE_MESSAGE.<10>
 	Mic []byte // 16 bytes
+	// Where the MIC was found in RawBytes
+	micOffset int
 
 	// payload - variable
 	Payload []byte
 }
 
-func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*Authenticate, error) {
+func ParseAuthenticateMessage(body []byte) (*Authenticate, error) {
+	return ParseAuthenticateMessageWithCodePage(body, CodePage437)
+}
+
+// Parse an authenticate message whose OEM strings are in the code page
+func ParseAuthenticateMessageWithCodePage(body []byte, codePage *CodePage) (*Authenticate, error) {
+	const structure = "AUTHENTICATE_MESSAGE"
+
+	// The shortest authenticate message (Win9x) ends after the Workstation security buffer
+	if len(body) < 52 {
+		return nil, parseError(structure, "", ErrTruncated)
+	}
+
 	am := new(Authenticate)
+	am.RawBytes = body
 
 	am.Signature = body[0:8]
 	if !bytes.Equal(am.Signature, []byte("NTLMSSP\x00")) {
-		return nil, errors.New("Invalid NTLM message signature")
+		return nil, parseError(structure, "Signature", ErrInvalidSignature)
 	}
 
 	am.MessageType = binary.LittleEndian.Uint32(body[8:12])
 	if am.MessageType != 3 {
-		return nil, errors.New("Invalid NTLM message type should be 0x00000003 for authenticate message")
+		return nil, parseError(structure, "MessageType", ErrInvalidMessageType)
 	}
 
 	var err error
 
 	am.LmChallengeResponse, err = ReadBytePayload(12, body)
 	if err != nil {
-		return nil, err
-	}
-
-	if ntlmVersion == 2 {
-		am.LmV2Response = ReadLmV2Response(am.LmChallengeResponse.Payload)
-	} else {
-		am.LmV1Response = ReadLmV1Response(am.LmChallengeResponse.Payload)
+		return nil, parseError(structure, "LmChallengeResponse", err)
 	}
 
 	am.NtChallengeResponseFields, err = ReadBytePayload(20, body)
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "NtChallengeResponse", err)
 	}
 
-	// Check to see if this is a v1 or v2 response
-	if ntlmVersion == 2 {
-		am.NtlmV2Response, err = ReadNtlmV2Response(am.NtChallengeResponseFields.Payload)
-	} else {
-		am.NtlmV1Response, err = ReadNtlmV1Response(am.NtChallengeResponseFields.Payload)
+	// The type of the response is detected from the length of the NT response: an NTLMv1 response is always 24 bytes,
+	// an NTLMv2 response is longer as it carries the client challenge structure. The NT response is empty in an
+	// anonymous authenticate message.
+	ntResponse := am.NtChallengeResponseFields.Payload
+	switch {
+	case len(ntResponse) == 0:
+	case len(ntResponse) == 24:
+		am.NtlmV1Response, err = ReadNtlmV1Response(ntResponse)
+	case len(ntResponse) >= 48:
+		am.NtlmV2Response, err = ReadNtlmV2Response(ntResponse)
+	default:
+		err = ErrInvalidValue
 	}
-
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "NtChallengeResponse", err)
+	}
+
+	// An anonymous authenticate message has a single zero byte (or nothing) for the LM response
+	if len(am.LmChallengeResponse.Payload) >= 24 {
+		if am.NtlmV2Response != nil {
+			am.LmV2Response, err = ReadLmV2Response(am.LmChallengeResponse.Payload)
+		} else {
+			am.LmV1Response, err = ReadLmV1Response(am.LmChallengeResponse.Payload)
+		}
+		if err != nil {
+			return nil, parseError(structure, "LmChallengeResponse", err)
+		}
 	}
 
 	am.DomainName, err = ReadStringPayload(28, body)
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "DomainName", err)
 	}
 
 	am.UserName, err = ReadStringPayload(36, body)
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "UserName", err)
 	}
 
 	am.Workstation, err = ReadStringPayload(44, body)
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "Workstation", err)
 	}
 
 	lowestOffset := am.getLowestPayloadOffset()
@@ -117,22 +146,41 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*Authenticate, erro
 	// security buffer header, at offset 52. This form is seen in older Win9x-based systems. This is from the davenport notes about Type 3
 	// messages and this information does not seem to be present in the MS-NLMP document
 	if lowestOffset > 52 {
+		if len(body) < 64 {
+			return nil, parseError(structure, "NegotiateFlags", ErrTruncated)
+		}
+
 		am.EncryptedRandomSessionKey, err = ReadBytePayload(offset, body)
 		if err != nil {
-			return nil, err
+			return nil, parseError(structure, "EncryptedRandomSessionKey", err)
 		}
 		offset = offset + 8
 
 		am.NegotiateFlags = binary.LittleEndian.Uint32(body[offset : offset+4])
 		offset = offset + 4
 
+		// The names were read as Unicode but are OEM strings when the OEM character set was negotiated
+		if IsOemNegotiated(am.NegotiateFlags) {
+			for _, p := range []*PayloadStruct{am.DomainName, am.UserName, am.Workstation} {
+				p.Type = OemStringPayload
+				p.CodePage = codePageOrDefault(codePage)
+			}
+		}
+
+		// The key may have moved the lowest offset
+		lowestOffset = am.getLowestPayloadOffset()
+
 		// Version (8 bytes): A VERSION structure (section 2.2.2.10) that is present only when the NTLMSSP_NEGOTIATE_VERSION flag is set in the NegotiateFlags field. This structure is used for debugging purposes only. In normal protocol messages, it is ignored and does not affect the NTLM message processing.<9>
-		if NTLMSSP_NEGOTIATE_VERSION.IsSet(am.NegotiateFlags) {
+		// Some clients set the flag without leaving room for the version, it is only read when it is before the payloads.
+		if NTLMSSP_NEGOTIATE_VERSION.IsSet(am.NegotiateFlags) && lowestOffset >= offset+8 && len(body) >= offset+8 {
 			am.Version, err = ReadVersionStruct(body[offset : offset+8])
 			if err != nil {
-				return nil, err
+				return nil, parseError(structure, "Version", err)
 			}
 			offset = offset + 8
+		} else if lowestOffset >= offset+8+16 {
+			// Some clients reserve the space for the version even when NTLMSSP_NEGOTIATE_VERSION is not set
+			offset = offset + 8
 		}
 
 		// The MS-NLMP has this to say about the MIC
@@ -141,23 +189,45 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*Authenticate, erro
 		// However there is no TargetInfo structure in the Authenticate Message! There is one in the Challenge Message though. So I'm using
 		// a hack to check to see if there is a MIC. I look to see if there is room for the MIC before the payload starts. If so I assume
 		// there is a MIC and read it out.
-		var lowestOffset = am.getLowestPayloadOffset()
-		if lowestOffset > offset {
+		if lowestOffset >= offset+16 && len(body) >= offset+16 {
 			// MIC - 16 bytes
 			am.Mic = body[offset : offset+16]
+			am.micOffset = offset
 			offset = offset + 16
 		}
+	} else {
+		am.EncryptedRandomSessionKey, _ = CreateBytePayload(make([]byte, 0))
+	}
+
+	names := []string{"LmChallengeResponse", "NtChallengeResponse", "DomainName", "UserName", "Workstation", "EncryptedRandomSessionKey"}
+	payloads := []*PayloadStruct{am.LmChallengeResponse, am.NtChallengeResponseFields, am.DomainName, am.UserName, am.Workstation, am.EncryptedRandomSessionKey}
+	err = checkPayloads(structure, offset, names, payloads)
+	if err != nil {
+		return nil, err
 	}
 
+	if offset > len(body) {
+		offset = len(body)
+	}
 	am.Payload = body[offset:]
 
 	return am, nil
 }
 
+// The NTLM version of the responses in the message, 1 or 2, or 0 for an anonymous message that has no NT response
+func (a *Authenticate) NtlmVersion() int {
+	if a.NtlmV2Response != nil {
+		return 2
+	} else if a.NtlmV1Response != nil {
+		return 1
+	}
+	return 0
+}
+
 func (a *Authenticate) ClientChallenge() (response []byte) {
 	if a.NtlmV2Response != nil {
 		response = a.NtlmV2Response.NtlmV2ClientChallenge.ChallengeFromClient
-	} else if a.NtlmV1Response != nil && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(a.NegotiateFlags) {
+	} else if a.NtlmV1Response != nil && a.LmV1Response != nil && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(a.NegotiateFlags) {
 		response = a.LmV1Response.Response[0:8]
 	}
 
@@ -240,6 +310,25 @@ func (a *Authenticate) Bytes() []byte {
 	return buffer.Bytes()
 }
 
+// The bytes of the message with the MIC set to zero, as used in the MIC calculation. For a parsed message these are
+// the bytes that were received, otherwise the message is serialized.
+func (a *Authenticate) BytesWithoutMic() []byte {
+	if a.RawBytes != nil {
+		result := make([]byte, len(a.RawBytes))
+		copy(result, a.RawBytes)
+		if a.micOffset > 0 {
+			copy(result[a.micOffset:a.micOffset+16], make([]byte, 16))
+		}
+		return result
+	}
+
+	mic := a.Mic
+	a.Mic = nil
+	result := a.Bytes()
+	a.Mic = mic
+	return result
+}
+
 func (a *Authenticate) String() string {
 	var buffer bytes.Buffer
 
@@ -4,6 +4,7 @@ package messages
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 )
@@ -14,16 +15,23 @@ func checkPayloadStruct(t *testing.T, payloadStruct *PayloadStruct, len uint16,
 	}
 }
 
-func TestParseNTLMv1AsV2(t *testing.T) {
+func TestParseDetectsNtlmVersion(t *testing.T) {
 	ntlmv1data := "TlRMTVNTUAADAAAAGAAYALYAAAAYABgAzgAAADQANABIAAAAIAAgAHwAAAAaABoAnAAAABAAEADmAAAAVYKQQgUCzg4AAAAPYQByAHIAYQB5ADEAMgAuAG0AcwBnAHQAcwB0AC4AcgBlAHUAdABlAHIAcwAuAGMAbwBtAHUAcwBlAHIAcwB0AHIAZQBzAHMAMQAwADAAMAAwADgATgBZAEMAVgBBADEAMgBTADIAQwBNAFMAQQDguXWdC2hLH+C5dZ0LaEsf4Ll1nQtoSx9nI+fkE73qtElnkDiSQbxfcDN9zbtO1qfyK3ZTI6CUhvjxmXnpZEjY"
 	authBytes, err := base64.StdEncoding.DecodeString(ntlmv1data)
-	_, err = ParseAuthenticateMessage(authBytes, 2)
-	if err == nil {
-		t.Error("Should have returned error when tring to parse an NTLMv1 authenticate message as NTLMv2")
-	}
-	_, err = ParseAuthenticateMessage(authBytes, 1)
+	a, err := ParseAuthenticateMessage(authBytes)
 	if err != nil {
-		t.Error("Should not have returned error when tring to parse an NTLMv1 authenticate message")
+		t.Fatal("Should not have returned error when tring to parse an NTLMv1 authenticate message")
+	}
+	if a.NtlmVersion() != 1 || a.NtlmV1Response == nil || a.LmV1Response == nil || a.NtlmV2Response != nil {
+		t.Error("Should have detected the NTLMv1 response")
+	}
+
+	// An NT response that is neither 24 bytes nor long enough for an NTLMv2 response is rejected
+	truncated := make([]byte, len(authBytes))
+	copy(truncated, authBytes)
+	binary.LittleEndian.PutUint16(truncated[20:], 20)
+	if _, err = ParseAuthenticateMessage(truncated); err == nil {
+		t.Error("Should have returned error for an NT response of 20 bytes")
 	}
 }
 
@@ -35,17 +43,17 @@ func TestAuthenticateNtlmV1(t *testing.T) {
 		t.Error("Could not base64 decode message data")
 	}
 
-	a, err := ParseAuthenticateMessage(authenticateData, 1)
+	a, err := ParseAuthenticateMessage(authenticateData)
 	if err != nil {
 		t.Error("Could not parse authenticate message")
 	}
 
-	a.String()
+	_ = a.String()
 
 	outBytes := a.Bytes()
 
 	if len(outBytes) > 0 {
-		reparsed, err := ParseAuthenticateMessage(outBytes, 1)
+		reparsed, err := ParseAuthenticateMessage(outBytes)
 		if err != nil {
 			t.Error("Could not re-parse authenticate message")
 		}
@@ -65,12 +73,16 @@ func TestAuthenticateNtlmV2(t *testing.T) {
 		t.Error("Could not base64 decode message data")
 	}
 
-	a, err := ParseAuthenticateMessage(authenticateData, 2)
+	a, err := ParseAuthenticateMessage(authenticateData)
 
 	if err != nil || a == nil {
 		t.Error("Failed to parse authenticate message " + err.Error())
 	}
 
+	if a.NtlmVersion() != 2 || a.LmV2Response == nil || a.NtlmV1Response != nil {
+		t.Error("Should have detected the NTLMv2 response")
+	}
+
 	checkPayloadStruct(t, a.LmChallengeResponse, 24, 142)
 	checkPayloadStruct(t, a.NtChallengeResponseFields, 262, 166)
 	checkPayloadStruct(t, a.DomainName, 0, 88)
@@ -91,7 +103,7 @@ func TestAuthenticateNtlmV2(t *testing.T) {
 		t.Errorf("Length of payload is incorrect got: %d, should be %d", len(a.Payload), 356)
 	}
 
-	a.String()
+	_ = a.String()
 
 	// Generate the bytes from the message and reparse it and make sure that works
 	bytes := a.Bytes()
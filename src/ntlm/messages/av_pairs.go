@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"time"
 )
 
 type AvPairType uint16
@@ -31,8 +32,8 @@ const (
 	MsvAvFlags
 	// A FILETIME structure ([MS-DTYP] section 2.3.1) in little-endian byte order that contains the server local time.<14>
 	MsvAvTimestamp
-	//A Restriction_Encoding (section 2.2.2.2) structure. The Value field contains a structure representing the integrity level of the security principal, as well as a MachineID created at computer startup to identify the calling machine.<15>
-	MsAvRestrictions
+	// A Single_Host_Data (section 2.2.2.2) structure. The Value field contains a platform-specific blob, as well as a MachineID created at computer startup to identify the calling machine.<15>
+	MsvAvSingleHost
 	// The SPN of the target server. The name MUST be in Unicode and is not null-terminated.<16>
 	MsvAvTargetName
 	// annel bindings hash. The Value field contains an MD5 hash ([RFC4121] section 4.1.1.2) of a gss_channel_bindings_struct ([RFC2744] section 3.11).
@@ -40,6 +41,19 @@ const (
 	MsvChannelBindings
 )
 
+// The name older versions of MS-NLMP used for MsvAvSingleHost, whose value was called Restriction_Encoding
+const MsAvRestrictions = MsvAvSingleHost
+
+// Bits of the MsvAvFlags value
+const (
+	// The account authentication is constrained
+	MsvAvFlagAuthenticationConstrained uint32 = 0x00000001
+	// The client is providing message integrity in the MIC field of the AUTHENTICATE_MESSAGE
+	MsvAvFlagMICProvided uint32 = 0x00000002
+	// The client is providing a target SPN generated from an untrusted source
+	MsvAvFlagUntrustedSPNSource uint32 = 0x00000004
+)
+
 // Helper struct that contains a list of AvPairs with helper methods for running through them
 type AvPairs struct {
 	List []AvPair
@@ -50,13 +64,46 @@ func (p *AvPairs) AddAvPair(avId AvPairType, bytes []byte) {
 	p.List = append(p.List, *a)
 }
 
-func ReadAvPairs(data []byte) *AvPairs {
+// Set the value of an AvPair, replacing the value if the pair is already present. New pairs are added before the
+// MsvAvEOL terminator, which is added if the list does not have one.
+func (p *AvPairs) SetAvPair(avId AvPairType, bytes []byte) {
+	a := AvPair{AvId: avId, AvLen: uint16(len(bytes)), Value: bytes}
+	for i := range p.List {
+		if p.List[i].AvId == avId && avId != MsvAvEOL {
+			p.List[i] = a
+			return
+		}
+	}
+
+	eol := len(p.List)
+	for i := range p.List {
+		if p.List[i].AvId == MsvAvEOL {
+			eol = i
+			break
+		}
+	}
+	list := make([]AvPair, 0, len(p.List)+2)
+	list = append(list, p.List[0:eol]...)
+	list = append(list, a)
+	if eol < len(p.List) {
+		list = append(list, p.List[eol:]...)
+	} else {
+		list = append(list, AvPair{AvId: MsvAvEOL, AvLen: 0, Value: make([]byte, 0)})
+	}
+	p.List = list
+}
+
+// Read AvPairs up to and including the MsvAvEOL terminator, an error is returned when a pair does not fit in data
+func ReadAvPairs(data []byte) (*AvPairs, error) {
 	pairs := new(AvPairs)
 
 	// Get the number of AvPairs and allocate enough AvPair structures to hold them
 	offset := 0
-	for i := 0; len(data) > 0 && i < 11; i++ {
-		pair := ReadAvPair(data, offset)
+	for offset+4 <= len(data) {
+		pair, err := ReadAvPair(data, offset)
+		if err != nil {
+			return nil, err
+		}
 		offset = offset + 4 + int(pair.AvLen)
 		pairs.List = append(pairs.List, *pair)
 		if pair.AvId == MsvAvEOL {
@@ -64,7 +111,7 @@ func ReadAvPairs(data []byte) *AvPairs {
 		}
 	}
 
-	return pairs
+	return pairs, nil
 }
 
 func (p *AvPairs) Bytes() (result []byte) {
@@ -123,6 +170,49 @@ func (p *AvPairs) StringValue(avType AvPairType) (result string) {
 	return
 }
 
+func (p *AvPairs) SetStringValue(avType AvPairType, value string) {
+	p.SetAvPair(avType, StringToUtf16(value))
+}
+
+// The MsvAvFlags value, zero when the pair is not present
+func (p *AvPairs) Flags() uint32 {
+	value := p.ByteValue(MsvAvFlags)
+	if len(value) != 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(value)
+}
+
+func (p *AvPairs) SetFlags(flags uint32) {
+	p.SetAvPair(MsvAvFlags, Uint32ToBytes(flags))
+}
+
+// The MsvAvTimestamp value, ok is false when the pair is not present or is not a FILETIME
+func (p *AvPairs) Timestamp() (timestamp time.Time, ok bool) {
+	value := p.ByteValue(MsvAvTimestamp)
+	if len(value) != 8 {
+		return time.Time{}, false
+	}
+	return FileTimeToTime(value), true
+}
+
+func (p *AvPairs) SetTimestamp(timestamp time.Time) {
+	p.SetAvPair(MsvAvTimestamp, TimeToFileTime(timestamp))
+}
+
+// The MsvAvSingleHost value, nil when the pair is not present
+func (p *AvPairs) SingleHost() (*SingleHostData, error) {
+	pair := p.Find(MsvAvSingleHost)
+	if pair == nil {
+		return nil, nil
+	}
+	return ReadSingleHostData(pair.Value)
+}
+
+func (p *AvPairs) SetSingleHost(data *SingleHostData) {
+	p.SetAvPair(MsvAvSingleHost, data.Bytes())
+}
+
 // AvPair as described by MS-NLMP
 type AvPair struct {
 	AvId  AvPairType
@@ -130,12 +220,18 @@ type AvPair struct {
 	Value []byte
 }
 
-func ReadAvPair(data []byte, offset int) *AvPair {
+func ReadAvPair(data []byte, offset int) (*AvPair, error) {
+	if offset < 0 || len(data) < offset+4 {
+		return nil, parseError("AV_PAIR", "AvId", ErrTruncated)
+	}
 	pair := new(AvPair)
 	pair.AvId = AvPairType(binary.LittleEndian.Uint16(data[offset : offset+2]))
 	pair.AvLen = binary.LittleEndian.Uint16(data[offset+2 : offset+4])
+	if len(data) < offset+4+int(pair.AvLen) {
+		return nil, parseError("AV_PAIR", "Value", ErrTruncated)
+	}
 	pair.Value = data[offset+4 : offset+4+int(pair.AvLen)]
-	return pair
+	return pair, nil
 }
 
 func (a *AvPair) UnicodeStringValue() string {
@@ -172,15 +268,56 @@ func (a *AvPair) String() string {
 		outString = "MsvAvFlags: " + hex.EncodeToString(a.Value)
 	case MsvAvTimestamp:
 		outString = "MsvAvTimestamp: " + hex.EncodeToString(a.Value)
-	case MsAvRestrictions:
-		outString = "MsAvRestrictions: " + hex.EncodeToString(a.Value)
+		if len(a.Value) == 8 {
+			outString = outString + " (" + FileTimeToTime(a.Value).UTC().String() + ")"
+		}
+	case MsvAvSingleHost:
+		outString = "MsvAvSingleHost: " + hex.EncodeToString(a.Value)
 	case MsvAvTargetName:
 		outString = "MsvAvTargetName: " + a.UnicodeStringValue()
 	case MsvChannelBindings:
 		outString = "MsvChannelBindings: " + hex.EncodeToString(a.Value)
 	default:
-		outString = fmt.Sprintf("unknown pair type: '%d'", a.AvId)
+		outString = fmt.Sprintf("unknown pair type: '%d' %s", a.AvId, hex.EncodeToString(a.Value))
 	}
 
 	return outString
 }
+
+// MS-NLMP 2.2.2.2 Single_Host_Data, sent by a client in MsvAvSingleHost to identify the machine it runs on
+type SingleHostData struct {
+	// 8 bytes of platform specific data, Windows puts the integrity level of the client in it
+	CustomData []byte
+	// 32 bytes, a random value created when the machine starts
+	MachineID []byte
+}
+
+// The size of Single_Host_Data, the Size field of the structure has this value
+const singleHostDataSize = 48
+
+func ReadSingleHostData(value []byte) (*SingleHostData, error) {
+	if len(value) < singleHostDataSize {
+		return nil, parseError("Single_Host_Data", "", ErrTruncated)
+	}
+	size := binary.LittleEndian.Uint32(value[0:4])
+	if size < singleHostDataSize || uint64(size) > uint64(len(value)) {
+		return nil, parseError("Single_Host_Data", "Size", ErrInvalidValue)
+	}
+	// Ignoring - 4 bytes Z4
+	data := new(SingleHostData)
+	data.CustomData = value[8:16]
+	data.MachineID = value[16:48]
+	return data, nil
+}
+
+func (s *SingleHostData) Bytes() []byte {
+	result := make([]byte, singleHostDataSize)
+	binary.LittleEndian.PutUint32(result[0:4], singleHostDataSize)
+	copy(result[8:16], s.CustomData)
+	copy(result[16:48], s.MachineID)
+	return result
+}
+
+func (s *SingleHostData) String() string {
+	return fmt.Sprintf("CustomData: %s MachineID: %s", hex.EncodeToString(s.CustomData), hex.EncodeToString(s.MachineID))
+}
@@ -0,0 +1,92 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAvPairValues(t *testing.T) {
+	pairs := new(AvPairs)
+	if pairs.Flags() != 0 {
+		t.Error("Flags should be zero when MsvAvFlags is not present")
+	}
+	if _, ok := pairs.Timestamp(); ok {
+		t.Error("Timestamp should not be found when MsvAvTimestamp is not present")
+	}
+
+	pairs.SetStringValue(MsvAvNbComputerName, "SERVER")
+	pairs.SetFlags(MsvAvFlagMICProvided | MsvAvFlagUntrustedSPNSource)
+	timestamp := time.Date(2013, 6, 17, 10, 0, 0, 123456700, time.UTC)
+	pairs.SetTimestamp(timestamp)
+	machineID := bytes.Repeat([]byte{0xab}, 32)
+	pairs.SetSingleHost(&SingleHostData{CustomData: []byte{1, 0, 0, 0, 0, 0x20, 0, 0}, MachineID: machineID})
+
+	reparsed, err := ReadAvPairs(pairs.Bytes())
+	if err != nil {
+		t.Fatalf("Could not read AvPairs: %s", err)
+	}
+	if reparsed.StringValue(MsvAvNbComputerName) != "SERVER" {
+		t.Errorf("Computer name is %s", reparsed.StringValue(MsvAvNbComputerName))
+	}
+	if reparsed.Flags() != MsvAvFlagMICProvided|MsvAvFlagUntrustedSPNSource {
+		t.Errorf("Flags are %x", reparsed.Flags())
+	}
+	if value, ok := reparsed.Timestamp(); !ok || !value.Equal(timestamp) {
+		t.Errorf("Timestamp is %s", value)
+	}
+	singleHost, err := reparsed.SingleHost()
+	if err != nil || !bytes.Equal(singleHost.MachineID, machineID) || singleHost.CustomData[5] != 0x20 {
+		t.Errorf("Single host data is %v, %v", singleHost, err)
+	}
+	if reparsed.List[len(reparsed.List)-1].AvId != MsvAvEOL {
+		t.Error("The last pair should be MsvAvEOL")
+	}
+}
+
+func TestSingleHostData(t *testing.T) {
+	// The MsvAvSingleHost value of a Windows 7 client
+	value, _ := hex.DecodeString("30000000000000000000000000200000c6e7e82f1f1fd7d5a2d1328d2b2e2eef1f73e6c1a0c72fae9fb2ad0aeba8cb2f")
+	data, err := ReadSingleHostData(value)
+	if err != nil {
+		t.Fatalf("Could not read single host data: %s", err)
+	}
+	if hex.EncodeToString(data.CustomData) != "0000000000200000" || hex.EncodeToString(data.MachineID[0:4]) != "c6e7e82f" {
+		t.Errorf("Single host data is %s", data.String())
+	}
+	if !bytes.Equal(data.Bytes(), value) {
+		t.Errorf("Single host data serialized to %x", data.Bytes())
+	}
+
+	_, err = ReadSingleHostData(value[0:40])
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated for short single host data but got %v", err)
+	}
+	if MsAvRestrictions != MsvAvSingleHost || MsvAvSingleHost != 8 {
+		t.Error("MsvAvSingleHost should have AvId 8")
+	}
+}
+
+func TestAvPairsPreserveUnknownIds(t *testing.T) {
+	// An MsvAvNbDomainName, an AvId this package does not know, MsvAvTimestamp and MsvAvEOL
+	data, _ := hex.DecodeString("02000400440043002a00050001020304050700080000d336b734c3010000000000")
+	pairs, err := ReadAvPairs(data)
+	if err != nil {
+		t.Fatalf("Could not read AvPairs: %s", err)
+	}
+	if !bytes.Equal(pairs.Bytes(), data) {
+		t.Errorf("AvPairs serialized to %x", pairs.Bytes())
+	}
+	if !bytes.Equal(pairs.ByteValue(42), []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Unknown AvId has value %x", pairs.ByteValue(42))
+	}
+
+	// Setting a value keeps the unknown pair where it was
+	pairs.SetFlags(MsvAvFlagMICProvided)
+	if pairs.List[1].AvId != 42 || !bytes.Equal(pairs.List[1].Bytes(), data[8:17]) {
+		t.Errorf("Unknown AvId was not preserved: %s", pairs.String())
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
 type Challenge struct {
+	// All bytes of the message as they were parsed, used when computing the MIC
+	RawBytes []byte
+
 	// sig - 8 bytes
 	Signature []byte
 	// message type - 4 bytes
@@ -53,48 +55,79 @@ type Challenge struct {
 }
 
 func ParseChallengeMessage(body []byte) (*Challenge, error) {
+	return ParseChallengeMessageWithCodePage(body, CodePage437)
+}
+
+// Parse a challenge message whose OEM strings are in the code page
+func ParseChallengeMessageWithCodePage(body []byte, codePage *CodePage) (*Challenge, error) {
+	const structure = "CHALLENGE_MESSAGE"
+
+	// The shortest challenge message (Win9x) ends after the server challenge
+	if len(body) < 32 {
+		return nil, parseError(structure, "", ErrTruncated)
+	}
+
 	challenge := new(Challenge)
+	challenge.RawBytes = body
 
 	challenge.Signature = body[0:8]
 	if !bytes.Equal(challenge.Signature, []byte("NTLMSSP\x00")) {
-		return challenge, errors.New("Invalid NTLM message signature")
+		return nil, parseError(structure, "Signature", ErrInvalidSignature)
 	}
 
 	challenge.MessageType = binary.LittleEndian.Uint32(body[8:12])
 	if challenge.MessageType != 2 {
-		return challenge, errors.New("Invalid NTLM message type should be 0x00000002 for challenge message")
+		return nil, parseError(structure, "MessageType", ErrInvalidMessageType)
 	}
 
 	var err error
 
-	challenge.TargetName, err = ReadStringPayload(12, body)
+	challenge.NegotiateFlags = binary.LittleEndian.Uint32(body[20:24])
+
+	challenge.TargetName, err = ReadNegotiatedStringPayload(12, body, challenge.NegotiateFlags, codePage)
 	if err != nil {
-		return nil, err
+		return nil, parseError(structure, "TargetName", err)
 	}
 
-	challenge.NegotiateFlags = binary.LittleEndian.Uint32(body[20:24])
-
 	challenge.ServerChallenge = body[24:32]
 
-	challenge.Reserved = body[32:40]
+	offset := 32
 
-	challenge.TargetInfoPayloadStruct, err = ReadBytePayload(40, body)
-	if err != nil {
-		return nil, err
-	}
+	// The context and target info are omitted when the target name starts at offset 32
+	if len(body) >= 48 && (challenge.TargetName.Len == 0 || challenge.TargetName.Offset >= 48) {
+		challenge.Reserved = body[32:40]
 
-	challenge.TargetInfo = ReadAvPairs(challenge.TargetInfoPayloadStruct.Payload)
+		challenge.TargetInfoPayloadStruct, err = ReadBytePayload(40, body)
+		if err != nil {
+			return nil, parseError(structure, "TargetInfo", err)
+		}
+		offset = 48
+	} else {
+		challenge.Reserved = make([]byte, 8)
+		challenge.TargetInfoPayloadStruct, _ = CreateBytePayload(make([]byte, 0))
+	}
 
-	offset := 48
+	challenge.TargetInfo, err = ReadAvPairs(challenge.TargetInfoPayloadStruct.Payload)
+	if err != nil {
+		return nil, parseError(structure, "TargetInfo", err)
+	}
 
-	if NTLMSSP_NEGOTIATE_VERSION.IsSet(challenge.NegotiateFlags) {
+	// The version is only read when it is before the payloads
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(challenge.NegotiateFlags) && len(body) >= offset+8 && challenge.getLowestPayloadOffset() >= offset+8 {
 		challenge.Version, err = ReadVersionStruct(body[offset : offset+8])
 		if err != nil {
-			return nil, err
+			return nil, parseError(structure, "Version", err)
 		}
 		offset = offset + 8
 	}
 
+	names := []string{"TargetName", "TargetInfo"}
+	payloads := []*PayloadStruct{challenge.TargetName, challenge.TargetInfoPayloadStruct}
+	err = checkPayloads(structure, offset, names, payloads)
+	if err != nil {
+		return nil, err
+	}
+
 	challenge.Payload = body[offset:]
 
 	return challenge, nil
@@ -123,11 +156,11 @@ func (c *Challenge) Bytes() []byte {
 	buffer.Write(c.TargetInfoPayloadStruct.Bytes())
 	payloadOffset += uint32(c.TargetInfoPayloadStruct.Len)
 
-	// if(c.Version != nil) {
-	buffer.Write(c.Version.Bytes())
-	// } else {
-	//  buffer.Write(make([]byte, 8))
-	//}
+	if c.Version != nil {
+		buffer.Write(c.Version.Bytes())
+	} else {
+		buffer.Write(make([]byte, 8))
+	}
 
 	// Write out the payloads
 	buffer.Write(c.TargetName.Payload)
@@ -4,7 +4,6 @@ package messages
 import (
 	"bytes"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
@@ -20,6 +19,9 @@ func (n *NtlmV1Response) String() string {
 }
 
 func ReadNtlmV1Response(bytes []byte) (*NtlmV1Response, error) {
+	if len(bytes) < 24 {
+		return nil, parseError("NTLM_RESPONSE", "Response", ErrTruncated)
+	}
 	r := new(NtlmV1Response)
 	r.Response = bytes[0:24]
 	return r, nil
@@ -83,6 +85,11 @@ func (n *NtlmV2Response) String() string {
 }
 
 func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
+	// The NTProofStr and the client challenge up to the AvPairs
+	if len(bytes) < 44 {
+		return nil, parseError("NTLMv2_RESPONSE", "NTLMv2_CLIENT_CHALLENGE", ErrTruncated)
+	}
+
 	r := new(NtlmV2Response)
 	r.Response = bytes[0:16]
 	r.NtlmV2ClientChallenge = new(NtlmV2ClientChallenge)
@@ -91,7 +98,7 @@ func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
 	c.HiRespType = bytes[17]
 
 	if c.RespType != 1 || c.HiRespType != 1 {
-		return nil, errors.New("Does not contain a valid NTLM v2 client challenge - could be NTLMv1.")
+		return nil, parseError("NTLMv2_CLIENT_CHALLENGE", "RespType", ErrInvalidValue)
 	}
 
 	// Ignoring - 2 bytes reserved
@@ -102,7 +109,11 @@ func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
 	c.ChallengeFromClient = bytes[32:40]
 	// Ignoring - 4 bytes reserved
 	// c.Reserved3
-	c.AvPairs = ReadAvPairs(bytes[44:])
+	var err error
+	c.AvPairs, err = ReadAvPairs(bytes[44:])
+	if err != nil {
+		return nil, parseError("NTLMv2_CLIENT_CHALLENGE", "AvPairs", err)
+	}
 	return r, nil
 }
 
@@ -113,10 +124,13 @@ type LmV1Response struct {
 	Response []byte
 }
 
-func ReadLmV1Response(bytes []byte) *LmV1Response {
+func ReadLmV1Response(bytes []byte) (*LmV1Response, error) {
+	if len(bytes) < 24 {
+		return nil, parseError("LM_RESPONSE", "Response", ErrTruncated)
+	}
 	r := new(LmV1Response)
 	r.Response = bytes[0:24]
-	return r
+	return r, nil
 }
 
 func (l *LmV1Response) String() string {
@@ -135,11 +149,14 @@ type LmV2Response struct {
 	ChallengeFromClient []byte
 }
 
-func ReadLmV2Response(bytes []byte) *LmV2Response {
+func ReadLmV2Response(bytes []byte) (*LmV2Response, error) {
+	if len(bytes) < 24 {
+		return nil, parseError("LMv2_RESPONSE", "Response", ErrTruncated)
+	}
 	r := new(LmV2Response)
 	r.Response = bytes[0:16]
 	r.ChallengeFromClient = bytes[16:24]
-	return r
+	return r, nil
 }
 
 func (l *LmV2Response) String() string {
@@ -0,0 +1,98 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"bytes"
+)
+
+// A single byte OEM code page, bytes below 0x80 are ASCII and the upper half is mapped by a table. OEM strings are
+// used in place of UTF-16 when NTLM_NEGOTIATE_OEM is negotiated instead of NTLMSSP_NEGOTIATE_UNICODE.
+type CodePage struct {
+	Name    string
+	upper   [128]rune
+	reverse map[rune]byte
+}
+
+// Create a code page from the characters of the bytes 0x80 to 0xFF
+func NewCodePage(name string, upper [128]rune) *CodePage {
+	c := &CodePage{Name: name, upper: upper, reverse: make(map[rune]byte)}
+	for i, r := range upper {
+		c.reverse[r] = byte(0x80 + i)
+	}
+	return c
+}
+
+// Encode a string in the code page, characters the code page does not have are replaced by '?'
+func (c *CodePage) Encode(value string) []byte {
+	var buffer bytes.Buffer
+	for _, r := range value {
+		if r < 0x80 {
+			buffer.WriteByte(byte(r))
+		} else if b, ok := c.reverse[r]; ok {
+			buffer.WriteByte(b)
+		} else {
+			buffer.WriteByte('?')
+		}
+	}
+	return buffer.Bytes()
+}
+
+func (c *CodePage) Decode(value []byte) string {
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		if b < 0x80 {
+			runes[i] = rune(b)
+		} else {
+			runes[i] = c.upper[b-0x80]
+		}
+	}
+	return string(runes)
+}
+
+// The OEM code page of US English Windows, used for OEM strings when no code page is given
+var CodePage437 = NewCodePage("437", [128]rune{
+	0x00C7, 0x00FC, 0x00E9, 0x00E2, 0x00E4, 0x00E0, 0x00E5, 0x00E7,
+	0x00EA, 0x00EB, 0x00E8, 0x00EF, 0x00EE, 0x00EC, 0x00C4, 0x00C5,
+	0x00C9, 0x00E6, 0x00C6, 0x00F4, 0x00F6, 0x00F2, 0x00FB, 0x00F9,
+	0x00FF, 0x00D6, 0x00DC, 0x00A2, 0x00A3, 0x00A5, 0x20A7, 0x0192,
+	0x00E1, 0x00ED, 0x00F3, 0x00FA, 0x00F1, 0x00D1, 0x00AA, 0x00BA,
+	0x00BF, 0x2310, 0x00AC, 0x00BD, 0x00BC, 0x00A1, 0x00AB, 0x00BB,
+	0x2591, 0x2592, 0x2593, 0x2502, 0x2524, 0x2561, 0x2562, 0x2556,
+	0x2555, 0x2563, 0x2551, 0x2557, 0x255D, 0x255C, 0x255B, 0x2510,
+	0x2514, 0x2534, 0x252C, 0x251C, 0x2500, 0x253C, 0x255E, 0x255F,
+	0x255A, 0x2554, 0x2569, 0x2566, 0x2560, 0x2550, 0x256C, 0x2567,
+	0x2568, 0x2564, 0x2565, 0x2559, 0x2558, 0x2552, 0x2553, 0x256B,
+	0x256A, 0x2518, 0x250C, 0x2588, 0x2584, 0x258C, 0x2590, 0x2580,
+	0x03B1, 0x00DF, 0x0393, 0x03C0, 0x03A3, 0x03C3, 0x00B5, 0x03C4,
+	0x03A6, 0x0398, 0x03A9, 0x03B4, 0x221E, 0x03C6, 0x03B5, 0x2229,
+	0x2261, 0x00B1, 0x2265, 0x2264, 0x2320, 0x2321, 0x00F7, 0x2248,
+	0x00B0, 0x2219, 0x00B7, 0x221A, 0x207F, 0x00B2, 0x25A0, 0x00A0,
+})
+
+// The OEM code page of Western European Windows
+var CodePage850 = NewCodePage("850", [128]rune{
+	0x00C7, 0x00FC, 0x00E9, 0x00E2, 0x00E4, 0x00E0, 0x00E5, 0x00E7,
+	0x00EA, 0x00EB, 0x00E8, 0x00EF, 0x00EE, 0x00EC, 0x00C4, 0x00C5,
+	0x00C9, 0x00E6, 0x00C6, 0x00F4, 0x00F6, 0x00F2, 0x00FB, 0x00F9,
+	0x00FF, 0x00D6, 0x00DC, 0x00F8, 0x00A3, 0x00D8, 0x00D7, 0x0192,
+	0x00E1, 0x00ED, 0x00F3, 0x00FA, 0x00F1, 0x00D1, 0x00AA, 0x00BA,
+	0x00BF, 0x00AE, 0x00AC, 0x00BD, 0x00BC, 0x00A1, 0x00AB, 0x00BB,
+	0x2591, 0x2592, 0x2593, 0x2502, 0x2524, 0x00C1, 0x00C2, 0x00C0,
+	0x00A9, 0x2563, 0x2551, 0x2557, 0x255D, 0x00A2, 0x00A5, 0x2510,
+	0x2514, 0x2534, 0x252C, 0x251C, 0x2500, 0x253C, 0x00E3, 0x00C3,
+	0x255A, 0x2554, 0x2569, 0x2566, 0x2560, 0x2550, 0x256C, 0x00A4,
+	0x00F0, 0x00D0, 0x00CA, 0x00CB, 0x00C8, 0x0131, 0x00CD, 0x00CE,
+	0x00CF, 0x2518, 0x250C, 0x2588, 0x2584, 0x00A6, 0x00CC, 0x2580,
+	0x00D3, 0x00DF, 0x00D4, 0x00D2, 0x00F5, 0x00D5, 0x00B5, 0x00FE,
+	0x00DE, 0x00DA, 0x00DB, 0x00D9, 0x00FD, 0x00DD, 0x00AF, 0x00B4,
+	0x00AD, 0x00B1, 0x2017, 0x00BE, 0x00B6, 0x00A7, 0x00F7, 0x00B8,
+	0x00B0, 0x00A8, 0x00B7, 0x00B9, 0x00B3, 0x00B2, 0x25A0, 0x00A0,
+})
+
+// The code page of OEM strings when no other is given
+func codePageOrDefault(c *CodePage) *CodePage {
+	if c == nil {
+		return CodePage437
+	}
+	return c
+}
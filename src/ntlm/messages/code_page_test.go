@@ -0,0 +1,64 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodePage(t *testing.T) {
+	encoded := CodePage437.Encode("Jürgen€")
+	if !bytes.Equal(encoded, []byte{'J', 0x81, 'r', 'g', 'e', 'n', '?'}) {
+		t.Errorf("Code page 437 encoded to %x", encoded)
+	}
+	if CodePage437.Decode(encoded[0:6]) != "Jürgen" {
+		t.Errorf("Code page 437 decoded to %s", CodePage437.Decode(encoded[0:6]))
+	}
+
+	encoded = CodePage850.Encode("Søren")
+	if !bytes.Equal(encoded, []byte{'S', 0x9B, 'r', 'e', 'n'}) || CodePage850.Decode(encoded) != "Søren" {
+		t.Errorf("Code page 850 encoded to %x", encoded)
+	}
+}
+
+func TestNegotiatedStringPayload(t *testing.T) {
+	oem := NTLM_NEGOTIATE_OEM.Set(0)
+	unicode := NTLMSSP_NEGOTIATE_UNICODE.Set(oem)
+
+	p, _ := CreateNegotiatedStringPayload("Jürgen", oem, nil)
+	if p.Type != OemStringPayload || p.Len != 6 || p.String() != "Jürgen" {
+		t.Errorf("Expected an OEM string payload, got type %d length %d", p.Type, p.Len)
+	}
+	p, _ = CreateNegotiatedStringPayload("Jürgen", unicode, nil)
+	if p.Type != UnicodeStringPayload || p.Len != 12 || p.String() != "Jürgen" {
+		t.Errorf("Expected a Unicode string payload, got type %d length %d", p.Type, p.Len)
+	}
+}
+
+func TestParseWithCodePage(t *testing.T) {
+	negotiate := new(Negotiate)
+	negotiate.Signature = []byte("NTLMSSP\x00")
+	negotiate.MessageType = 1
+	negotiate.NegotiateFlags = NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.Set(NTLM_NEGOTIATE_OEM.Set(0))
+	negotiate.DomainNameFields, _ = CreateOemStringPayload("Søren", CodePage850)
+	negotiate.WorkstationFields, _ = CreateBytePayload(make([]byte, 0))
+
+	parsed, err := ParseNegotiateMessageWithCodePage(negotiate.Bytes(), CodePage850)
+	if err != nil {
+		t.Fatalf("Could not parse negotiate message: %s", err)
+	}
+	if parsed.DomainNameFields.String() != "Søren" {
+		t.Errorf("Code page 850 parse got %s", parsed.DomainNameFields.String())
+	}
+	// Parsing with another code page does not change the strings of other messages
+	parsed437, _ := ParseNegotiateMessage(negotiate.Bytes())
+	if parsed437.DomainNameFields.String() != "S¢ren" || parsed.DomainNameFields.String() != "Søren" {
+		t.Errorf("Code page 437 parse got %s", parsed437.DomainNameFields.String())
+	}
+}
+
+func TestStringToUtf16(t *testing.T) {
+	if Utf16ToString(StringToUtf16("Jürgen €")) != "Jürgen €" {
+		t.Error("Non ASCII characters did not survive UTF-16")
+	}
+}
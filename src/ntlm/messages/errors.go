@@ -0,0 +1,74 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// The data ends before the structure or payload that is being read
+	ErrTruncated = errors.New("Data is truncated")
+	// A payload overlaps another payload or the fixed fields of the message
+	ErrOverlap = errors.New("Payload overlaps other data")
+	// The message does not start with NTLMSSP\0
+	ErrInvalidSignature = errors.New("Invalid NTLM message signature")
+	// The message type is not the one that is being parsed
+	ErrInvalidMessageType = errors.New("Invalid NTLM message type")
+	// A field has a value that is not allowed
+	ErrInvalidValue = errors.New("Invalid value")
+
+	// Every ParseError matches it with errors.Is, whatever the reason the message could not be parsed
+	ErrMalformedMessage = errors.New("Malformed NTLM message")
+)
+
+// The error returned by the parsers in this package, Err is one of the errors above and can be checked with errors.Is
+type ParseError struct {
+	// The structure and the field that could not be parsed, for example AUTHENTICATE_MESSAGE and UserName
+	Structure string
+	Field     string
+	Err       error
+}
+
+func (e *ParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Could not parse %s: %s", e.Structure, e.Err)
+	}
+	return fmt.Sprintf("Could not parse %s %s: %s", e.Structure, e.Field, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrMalformedMessage
+}
+
+// Wrap err in a ParseError for the field, an error that already is a ParseError describes a nested structure and is
+// returned as it is
+func parseError(structure, field string, err error) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Structure: structure, Field: field, Err: err}
+}
+
+// Check that the non empty payloads start after the fixed fields of the message and do not overlap each other
+func checkPayloads(structure string, headerLength int, names []string, payloads []*PayloadStruct) error {
+	for i, p := range payloads {
+		if p == nil || p.Len == 0 {
+			continue
+		}
+		if int(p.Offset) < headerLength {
+			return parseError(structure, names[i], ErrOverlap)
+		}
+		for j := 0; j < i; j++ {
+			q := payloads[j]
+			if q != nil && q.Len > 0 && p.Offset < q.Offset+uint32(q.Len) && q.Offset < p.Offset+uint32(p.Len) {
+				return parseError(structure, names[i], ErrOverlap)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func checkParseError(t *testing.T, name string, err error, expected error) {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || !errors.Is(err, expected) {
+		t.Errorf("%s: expected a ParseError for %v but got %v", name, expected, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	authenticate, _ := base64.StdEncoding.DecodeString(authenticateSeeds[1])
+	modified := func(change func(data []byte)) []byte {
+		data := make([]byte, len(authenticate))
+		copy(data, authenticate)
+		change(data)
+		return data
+	}
+
+	_, err := ParseAuthenticateMessage(authenticate[0:4])
+	checkParseError(t, "Short message", err, ErrTruncated)
+
+	_, err = ParseAuthenticateMessage(modified(func(data []byte) { data[0] = 'X' }))
+	checkParseError(t, "Signature", err, ErrInvalidSignature)
+
+	_, err = ParseAuthenticateMessage(modified(func(data []byte) { data[8] = 2 }))
+	checkParseError(t, "Message type", err, ErrInvalidMessageType)
+
+	// The user name runs past the end of the message
+	_, err = ParseAuthenticateMessage(modified(func(data []byte) { binary.LittleEndian.PutUint16(data[36:], 0xffff) }))
+	checkParseError(t, "Payload past the end", err, ErrTruncated)
+
+	// The user name starts inside the fixed fields of the message
+	_, err = ParseAuthenticateMessage(modified(func(data []byte) { binary.LittleEndian.PutUint32(data[40:], 60) }))
+	checkParseError(t, "Payload in the header", err, ErrOverlap)
+
+	// The user name points at the workstation
+	_, err = ParseAuthenticateMessage(modified(func(data []byte) { copy(data[40:44], data[48:52]) }))
+	checkParseError(t, "Overlapping payloads", err, ErrOverlap)
+
+	_, err = ParseChallengeMessage(authenticate[0:20])
+	checkParseError(t, "Short challenge", err, ErrTruncated)
+
+	// The target info of the challenge holds an AvPair that claims more bytes than there are
+	challenge := make([]byte, 48)
+	copy(challenge, "NTLMSSP\x00\x02")
+	binary.LittleEndian.PutUint32(challenge[16:], 48)
+	binary.LittleEndian.PutUint16(challenge[40:], 6)
+	binary.LittleEndian.PutUint16(challenge[42:], 6)
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, 0x02, 0x00, 0x10, 0x00, 'D', 0x00)
+	_, err = ParseChallengeMessage(challenge)
+	checkParseError(t, "Challenge target info", err, ErrTruncated)
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected the challenge target info error to match ErrMalformedMessage but got %v", err)
+	}
+
+	_, err = ParseNegotiateMessage(authenticate[0:12])
+	checkParseError(t, "Short negotiate", err, ErrTruncated)
+
+	// An AvPair that claims more bytes than there are
+	_, err = ReadAvPairs([]byte{0x02, 0x00, 0x10, 0x00, 'D', 0x00})
+	checkParseError(t, "AvPair", err, ErrTruncated)
+
+	_, err = ReadNtlmV2Response(make([]byte, 48))
+	checkParseError(t, "NTLMv2 response type", err, ErrInvalidValue)
+}
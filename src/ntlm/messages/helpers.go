@@ -3,6 +3,7 @@ package messages
 
 import (
 	"encoding/binary"
+	"time"
 	"unicode/utf16"
 )
 
@@ -11,7 +12,8 @@ func Utf16ToString(bytes []byte) string {
 	var data []uint16
 
 	// NOTE: This is definitely not the best way to do this, but when I tried using a buffer.Read I could not get it to work
-	for offset := 0; offset < len(bytes); offset = offset + 2 {
+	// A trailing odd byte is not a character and is ignored
+	for offset := 0; offset+2 <= len(bytes); offset = offset + 2 {
 		i := binary.LittleEndian.Uint16(bytes[offset : offset+2])
 		data = append(data, i)
 	}
@@ -20,10 +22,10 @@ func Utf16ToString(bytes []byte) string {
 }
 
 func StringToUtf16(value string) []byte {
-	result := make([]byte, len(value)*2)
-	stringBytes := []byte(value)
-	for i := 0; i < len(value); i++ {
-		result[i*2] = stringBytes[i]
+	data := utf16.Encode([]rune(value))
+	result := make([]byte, len(data)*2)
+	for i, v := range data {
+		binary.LittleEndian.PutUint16(result[i*2:], v)
 	}
 	return result
 }
@@ -36,3 +38,23 @@ func Uint32ToBytes(v uint32) []byte {
 	bytes[3] = byte((v >> 24) & 0xff)
 	return bytes
 }
+
+// A FILETIME is the number of 100 nanosecond intervals since January 1, 1601 (UTC)
+const fileTimeUnixEpoch = int64(116444736000000000)
+
+// Convert a time to a little endian FILETIME
+func TimeToFileTime(t time.Time) []byte {
+	ll := (t.Unix() * int64(10000000)) + int64(t.Nanosecond()/100) + fileTimeUnixEpoch
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, uint64(ll))
+	return result
+}
+
+// Convert a little endian FILETIME to a time, the zero time is returned when fileTime is not 8 bytes
+func FileTimeToTime(fileTime []byte) time.Time {
+	if len(fileTime) != 8 {
+		return time.Time{}
+	}
+	ll := int64(binary.LittleEndian.Uint64(fileTime)) - fileTimeUnixEpoch
+	return time.Unix(ll/10000000, (ll%10000000)*100)
+}
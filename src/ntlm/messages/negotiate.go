@@ -1,9 +1,15 @@
 //Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
 package messages
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
 type Negotiate struct {
-	// All bytes of the message
-	Bytes []byte
+	// All bytes of the message as they were parsed, used when computing the MIC
+	RawBytes []byte
 
 	// sig - 8 bytes
 	Signature []byte
@@ -24,3 +30,138 @@ type Negotiate struct {
 	Payload       []byte
 	PayloadOffset int
 }
+
+func ParseNegotiateMessage(body []byte) (*Negotiate, error) {
+	return ParseNegotiateMessageWithCodePage(body, CodePage437)
+}
+
+// Parse a negotiate message whose OEM strings are in the code page
+func ParseNegotiateMessageWithCodePage(body []byte, codePage *CodePage) (*Negotiate, error) {
+	// The shortest negotiate message seen in the wild (Win9x) only contains the signature, type and flags
+	const structure = "NEGOTIATE_MESSAGE"
+
+	if len(body) < 16 {
+		return nil, parseError(structure, "", ErrTruncated)
+	}
+
+	nm := new(Negotiate)
+	nm.RawBytes = body
+
+	nm.Signature = body[0:8]
+	if !bytes.Equal(nm.Signature, []byte("NTLMSSP\x00")) {
+		return nil, parseError(structure, "Signature", ErrInvalidSignature)
+	}
+
+	nm.MessageType = binary.LittleEndian.Uint32(body[8:12])
+	if nm.MessageType != 1 {
+		return nil, parseError(structure, "MessageType", ErrInvalidMessageType)
+	}
+
+	nm.NegotiateFlags = binary.LittleEndian.Uint32(body[12:16])
+
+	offset := 16
+	if len(body) >= 32 {
+		var err error
+		// The domain and workstation names are always OEM strings in the negotiate message
+		nm.DomainNameFields, err = ReadOemStringPayload(16, body, codePage)
+		if err != nil {
+			return nil, parseError(structure, "DomainName", err)
+		}
+
+		nm.WorkstationFields, err = ReadOemStringPayload(24, body, codePage)
+		if err != nil {
+			return nil, parseError(structure, "Workstation", err)
+		}
+		offset = 32
+
+		// The version is only read when it is before the payloads
+		names := []string{"DomainName", "Workstation"}
+		payloads := []*PayloadStruct{nm.DomainNameFields, nm.WorkstationFields}
+		if NTLMSSP_NEGOTIATE_VERSION.IsSet(nm.NegotiateFlags) && len(body) >= 40 && checkPayloads(structure, 40, names, payloads) == nil {
+			nm.Version, err = ReadVersionStruct(body[offset : offset+8])
+			if err != nil {
+				return nil, parseError(structure, "Version", err)
+			}
+			offset = offset + 8
+		}
+
+		err = checkPayloads(structure, offset, names, payloads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nm.PayloadOffset = offset
+	nm.Payload = body[offset:]
+
+	return nm, nil
+}
+
+func (n *Negotiate) Bytes() []byte {
+	if n.DomainNameFields == nil {
+		n.DomainNameFields, _ = CreateBytePayload(make([]byte, 0))
+	}
+	if n.WorkstationFields == nil {
+		n.WorkstationFields, _ = CreateBytePayload(make([]byte, 0))
+	}
+
+	payloadLen := int(n.DomainNameFields.Len + n.WorkstationFields.Len)
+	messageLen := 8 + 4 + 4 + 8 + 8
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(n.NegotiateFlags) {
+		messageLen = messageLen + 8
+	}
+	payloadOffset := uint32(messageLen)
+
+	messageBytes := make([]byte, 0, messageLen+payloadLen)
+	buffer := bytes.NewBuffer(messageBytes)
+
+	buffer.Write(n.Signature)
+	binary.Write(buffer, binary.LittleEndian, n.MessageType)
+	binary.Write(buffer, binary.LittleEndian, n.NegotiateFlags)
+
+	n.DomainNameFields.Offset = payloadOffset
+	buffer.Write(n.DomainNameFields.Bytes())
+	payloadOffset += uint32(n.DomainNameFields.Len)
+
+	n.WorkstationFields.Offset = payloadOffset
+	buffer.Write(n.WorkstationFields.Bytes())
+	payloadOffset += uint32(n.WorkstationFields.Len)
+
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(n.NegotiateFlags) {
+		if n.Version != nil {
+			buffer.Write(n.Version.Bytes())
+		} else {
+			buffer.Write(make([]byte, 8))
+		}
+	}
+
+	// Write out the payloads
+	buffer.Write(n.DomainNameFields.Payload)
+	buffer.Write(n.WorkstationFields.Payload)
+
+	return buffer.Bytes()
+}
+
+func (n *Negotiate) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("Negotiate NTLM Message\n")
+	buffer.WriteString(fmt.Sprintf("Payload Offset: %d Length: %d\n", n.PayloadOffset, len(n.Payload)))
+
+	if n.DomainNameFields != nil {
+		buffer.WriteString(fmt.Sprintf("DomainName: %s\n", n.DomainNameFields.String()))
+	}
+
+	if n.WorkstationFields != nil {
+		buffer.WriteString(fmt.Sprintf("Workstation: %s\n", n.WorkstationFields.String()))
+	}
+
+	if n.Version != nil {
+		buffer.WriteString(fmt.Sprintf("Version: %s\n", n.Version.String()))
+	}
+
+	buffer.WriteString(fmt.Sprintf("Flags %d\n", n.NegotiateFlags))
+	buffer.WriteString(FlagsToString(n.NegotiateFlags))
+
+	return buffer.String()
+}
@@ -135,6 +135,11 @@ func (f NegotiateFlag) Unset(flags uint32) uint32 {
 	return flags &^ uint32(f)
 }
 
+// True when the flags select OEM strings, Unicode is used when NTLMSSP_NEGOTIATE_UNICODE is set and when neither is set
+func IsOemNegotiated(flags uint32) bool {
+	return NTLM_NEGOTIATE_OEM.IsSet(flags) && !NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags)
+}
+
 func (f NegotiateFlag) String() string {
 	return reflect.TypeOf(f).Name()
 }
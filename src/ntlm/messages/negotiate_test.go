@@ -0,0 +1,65 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package messages
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseNegotiate(t *testing.T) {
+	// Sample Type 1 message from http://davenport.sourceforge.net/ntlm.html#theType1Message
+	negotiateData, _ := hex.DecodeString("4e544c4d53535000010000000732000006000600330000000b000b0028000000050093080000000f574f524b53544154494f4e444f4d41494e")
+
+	negotiate, err := ParseNegotiateMessage(negotiateData)
+	if err != nil {
+		t.Fatalf("Could not parse negotiate message: %s", err)
+	}
+
+	if negotiate.NegotiateFlags != uint32(0x00003207) {
+		t.Errorf("Negotiate flags not correct should be %d got %d", uint32(0x00003207), negotiate.NegotiateFlags)
+	}
+
+	if negotiate.DomainNameFields.String() != "DOMAIN" {
+		t.Errorf("Domain name not correct got '%s'", negotiate.DomainNameFields.String())
+	}
+
+	if negotiate.WorkstationFields.String() != "WORKSTATION" {
+		t.Errorf("Workstation not correct got '%s'", negotiate.WorkstationFields.String())
+	}
+
+	_ = negotiate.String()
+}
+
+func TestNegotiateBytes(t *testing.T) {
+	negotiate := new(Negotiate)
+	negotiate.Signature = []byte("NTLMSSP\x00")
+	negotiate.MessageType = 1
+	negotiate.NegotiateFlags = NTLMSSP_NEGOTIATE_VERSION.Set(NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.Set(NTLMSSP_NEGOTIATE_UNICODE.Set(0)))
+	negotiate.DomainNameFields, _ = CreateOemStringPayload("DOMAIN", nil)
+	negotiate.Version = &VersionStruct{ProductMajorVersion: 6, ProductMinorVersion: 1, ProductBuild: 7601, NTLMRevisionCurrent: 15}
+
+	reparsed, err := ParseNegotiateMessage(negotiate.Bytes())
+	if err != nil {
+		t.Fatalf("Could not re-parse negotiate message: %s", err)
+	}
+	again, err := ParseNegotiateMessage(reparsed.Bytes())
+	if err != nil || again.String() != reparsed.String() {
+		t.Error("Reparsed message is not the same")
+	}
+	if reparsed.DomainNameFields.Offset != 40 || reparsed.Version.ProductBuild != 7601 {
+		t.Error("Negotiate message layout is not correct")
+	}
+}
+
+func TestParseShortNegotiate(t *testing.T) {
+	negotiateData, _ := hex.DecodeString("4e544c4d535350000100000007820000")
+	negotiate, err := ParseNegotiateMessage(negotiateData)
+	if err != nil || negotiate.NegotiateFlags != 0x8207 {
+		t.Errorf("Could not parse negotiate message without payload fields: %v", err)
+	}
+
+	_, err = ParseNegotiateMessage(negotiateData[0:12])
+	if err == nil {
+		t.Error("Truncated negotiate message should not parse")
+	}
+}
@@ -19,6 +19,8 @@ type PayloadStruct struct {
 	MaxLen  uint16
 	Offset  uint32
 	Payload []byte
+	// The code page of an OEM string, CodePage437 when it is nil
+	CodePage *CodePage
 }
 
 func (p *PayloadStruct) Bytes() []byte {
@@ -39,7 +41,7 @@ func (p *PayloadStruct) String() string {
 	case UnicodeStringPayload:
 		returnString = Utf16ToString(p.Payload)
 	case OemStringPayload:
-		returnString = string(p.Payload)
+		returnString = codePageOrDefault(p.CodePage).Decode(p.Payload)
 	case BytesPayload:
 		returnString = hex.EncodeToString(p.Payload)
 	default:
@@ -68,15 +70,60 @@ func CreateStringPayload(value string) (*PayloadStruct, error) {
 	return p, nil
 }
 
+// Create an OEM string payload in the code page, CodePage437 is used when it is nil
+func CreateOemStringPayload(value string, codePage *CodePage) (*PayloadStruct, error) {
+	codePage = codePageOrDefault(codePage)
+	bytes := codePage.Encode(value)
+	p := new(PayloadStruct)
+	p.Type = OemStringPayload
+	p.CodePage = codePage
+	p.Len = uint16(len(bytes))
+	p.MaxLen = uint16(len(bytes))
+	p.Payload = bytes
+	return p, nil
+}
+
+// Create a Unicode or OEM string payload, depending on the character set selected by the negotiate flags
+func CreateNegotiatedStringPayload(value string, flags uint32, codePage *CodePage) (*PayloadStruct, error) {
+	if IsOemNegotiated(flags) {
+		return CreateOemStringPayload(value, codePage)
+	}
+	return CreateStringPayload(value)
+}
+
 func ReadStringPayload(startByte int, bytes []byte) (*PayloadStruct, error) {
 	return ReadPayloadStruct(startByte, bytes, UnicodeStringPayload)
 }
 
+// Read a Unicode or OEM string payload, depending on the character set selected by the negotiate flags
+func ReadNegotiatedStringPayload(startByte int, bytes []byte, flags uint32, codePage *CodePage) (*PayloadStruct, error) {
+	if IsOemNegotiated(flags) {
+		return ReadOemStringPayload(startByte, bytes, codePage)
+	}
+	return ReadStringPayload(startByte, bytes)
+}
+
+// Read an OEM string payload in the code page, CodePage437 is used when it is nil
+func ReadOemStringPayload(startByte int, bytes []byte, codePage *CodePage) (*PayloadStruct, error) {
+	p, err := ReadPayloadStruct(startByte, bytes, OemStringPayload)
+	if err != nil {
+		return nil, err
+	}
+	p.CodePage = codePageOrDefault(codePage)
+	return p, nil
+}
+
 func ReadBytePayload(startByte int, bytes []byte) (*PayloadStruct, error) {
 	return ReadPayloadStruct(startByte, bytes, BytesPayload)
 }
 
+// Read the security buffer at startByte and the payload it points to, ErrTruncated is returned when either is not
+// inside bytes
 func ReadPayloadStruct(startByte int, bytes []byte, PayloadType int) (*PayloadStruct, error) {
+	if startByte < 0 || len(bytes) < startByte+8 {
+		return nil, ErrTruncated
+	}
+
 	p := new(PayloadStruct)
 
 	p.Type = PayloadType
@@ -85,7 +132,10 @@ func ReadPayloadStruct(startByte int, bytes []byte, PayloadType int) (*PayloadSt
 	p.Offset = binary.LittleEndian.Uint32(bytes[startByte+4 : startByte+8])
 
 	if p.Len > 0 {
-		endOffset := p.Offset + uint32(p.Len)
+		endOffset := uint64(p.Offset) + uint64(p.Len)
+		if endOffset > uint64(len(bytes)) {
+			return nil, ErrTruncated
+		}
 		p.Payload = bytes[p.Offset:endOffset]
 	}
 
@@ -16,6 +16,9 @@ type VersionStruct struct {
 }
 
 func ReadVersionStruct(structSource []byte) (*VersionStruct, error) {
+	if len(structSource) < 8 {
+		return nil, parseError("VERSION", "", ErrTruncated)
+	}
 	versionStruct := new(VersionStruct)
 
 	versionStruct.ProductMajorVersion = uint8(structSource[0])
@@ -27,6 +30,14 @@ func ReadVersionStruct(structSource []byte) (*VersionStruct, error) {
 	return versionStruct, nil
 }
 
+// The NTLMRevisionCurrent of the version, 0 when a message has no version
+func (v *VersionStruct) NtlmRevision() uint8 {
+	if v == nil {
+		return 0
+	}
+	return v.NTLMRevisionCurrent
+}
+
 func (v *VersionStruct) String() string {
 	return fmt.Sprintf("%d.%d.%d Ntlm %d", v.ProductMajorVersion, v.ProductMinorVersion, v.ProductBuild, v.NTLMRevisionCurrent)
 }
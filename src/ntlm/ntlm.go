@@ -4,9 +4,12 @@
 package ntlm
 
 import (
+	hmacP "crypto/hmac"
 	rc4P "crypto/rc4"
 	"errors"
 	"ntlm/messages"
+	"strings"
+	"time"
 )
 
 type Version int
@@ -14,6 +17,8 @@ type Version int
 const (
 	Version1 Version = 1
 	Version2 Version = 2
+	// A server that detects the version from the response of the client
+	VersionAuto Version = 0
 )
 
 type Mode int
@@ -36,34 +41,50 @@ func CreateClientSession(version Version, mode Mode) (n ClientSession, err error
 		return nil, errors.New("Unknown NTLM Version, must be 1 or 2")
 	}
 
+	n.SetMode(mode)
 	return n, nil
 }
 
 type ClientSession interface {
 	SetUserInfo(username string, password string, domain string)
+	SetUserHash(username string, ntHash []byte, domain string) error
+	SetUserCredential(username string, credential *Credential, domain string) error
+	SetClientInfo(info ClientInfo)
+	SetChannelBindings(applicationData []byte)
+	SetTargetName(spn string, untrustedSource bool)
+	SetLmCompatibilityLevel(level LmCompatibilityLevel)
 	SetMode(mode Mode)
+	SetSupportedFlags(flags uint32)
+	SetRequiredFlags(flags uint32)
+	SetOemCodePage(codePage *messages.CodePage)
+	SetLogger(logger Logger)
 
 	GenerateNegotiateMessage() (*messages.Negotiate, error)
 	ProcessChallengeMessage(*messages.Challenge) error
 	GenerateAuthenticateMessage() (*messages.Authenticate, error)
 
-	Seal(message []byte) ([]byte, error)
-	Sign(message []byte) ([]byte, error)
+	// In ConnectionOrientedMode the sequence number is tracked by the session and the sequenceNumber argument is ignored
+	Seal(message []byte, sequenceNumber int) (sealedMessage, signature []byte, err error)
+	Unseal(sealedMessage, signature []byte, sequenceNumber int) (message []byte, ok bool, err error)
+	Sign(message []byte, sequenceNumber int) ([]byte, error)
 	Mac(message []byte, sequenceNumber int) ([]byte, error)
 	VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error)
 }
 
 // Creates an NTLM v1 or v2 server
 // mode - This must be ConnectionlessMode or ConnectionOrientedMode depending on what type of NTLM is used
-// version - This must be Version1 or Version2 depending on the version of NTLM used
+// version - This must be Version1 or Version2 depending on the version of NTLM used, or VersionAuto to detect it. A
+// VersionAuto server only accepts NTLMv1 when an LmCompatibilityLevel that allows it is set.
 func CreateServerSession(version Version, mode Mode) (n ServerSession, err error) {
 	switch version {
 	case Version1:
 		n = new(V1ServerSession)
 	case Version2:
 		n = new(V2ServerSession)
+	case VersionAuto:
+		n = new(AutoServerSession)
 	default:
-		return nil, errors.New("Unknown NTLM Version, must be 1 or 2")
+		return nil, errors.New("Unknown NTLM Version, must be 1, 2 or auto")
 	}
 
 	n.SetMode(mode)
@@ -72,20 +93,40 @@ func CreateServerSession(version Version, mode Mode) (n ServerSession, err error
 
 type ServerSession interface {
 	SetUserInfo(username string, password string, domain string)
+	SetUserHash(username string, ntHash []byte, domain string) error
+	SetUserCredential(username string, credential *Credential, domain string) error
 	GetUserInfo() (string, string, string)
+	GetWorkstation() string
 
 	SetMode(mode Mode)
+	// The challenge is sent to the client by other means, clients that send a MIC are refused with ErrMicWithoutChallenge
 	SetServerChallenge(challege []byte)
+	SetServerInfo(info ServerInfo)
+	SetCredentialStore(store CredentialStore)
+	SetMaxClockSkew(skew time.Duration)
+	SetOemCodePage(codePage *messages.CodePage)
+	SetChallengeManager(manager *ChallengeManager)
+	SetChannelBindings(applicationData []byte)
+	SetChannelBindingPolicy(policy ChannelBindingPolicy)
+	SetAcceptedTargetNames(spns []string, required bool)
+	SetAllowAnonymous(allow bool)
+	SetLmCompatibilityLevel(level LmCompatibilityLevel)
+	SetSupportedFlags(flags uint32)
+	SetRequiredFlags(flags uint32)
+	SetLogger(logger Logger)
 
 	ProcessNegotiateMessage(*messages.Negotiate) error
 	GenerateChallengeMessage() (*messages.Challenge, error)
 	ProcessAuthenticateMessage(*messages.Authenticate) error
 
 	GetSessionData() *SessionData
+	IsAnonymous() bool
 
 	Version() int
-	Seal(message []byte) ([]byte, error)
-	Sign(message []byte) ([]byte, error)
+	// In ConnectionOrientedMode the sequence number is tracked by the session and the sequenceNumber argument is ignored
+	Seal(message []byte, sequenceNumber int) (sealedMessage, signature []byte, err error)
+	Unseal(sealedMessage, signature []byte, sequenceNumber int) (message []byte, ok bool, err error)
+	Sign(message []byte, sequenceNumber int) ([]byte, error)
 	Mac(message []byte, sequenceNumber int) ([]byte, error)
 	VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error)
 }
@@ -93,12 +134,53 @@ type ServerSession interface {
 // This struct collects NTLM data structures and keys that are used across all types of NTLM requests
 type SessionData struct {
 	mode Mode
+	// How far the handshake has got
+	state sessionState
+	// Receives the events of the session, the default logger is used when it is nil
+	logger Logger
 
 	user       string
 	password   string
 	userDomain string
+	// Set instead of the password when the hashes of the password are known
+	credential *Credential
+
+	// Consulted by a server for the credential of the authenticating user
+	credentialStore CredentialStore
+	// How far the timestamp of an NTLMv2 response may be from the server time, zero disables the check
+	maxClockSkew time.Duration
+	// The code page of the OEM strings the session sends and receives, CodePage437 when it is nil
+	oemCodePage *messages.CodePage
+	// Issues the server challenges and refuses challenges and responses that are used again, the handle identifies the
+	// challenge issued to this session
+	challengeManager *ChallengeManager
+	challengeHandle  ChallengeHandle
+	// MD5 hash of the channel bindings of the secure channel, and how a server checks the ones sent by the client
+	channelBindings      []byte
+	channelBindingPolicy ChannelBindingPolicy
+	// The SPN a client sends and the SPNs a server accepts
+	targetName          string
+	targetNameUntrusted bool
+	acceptedTargetNames []string
+	targetNameRequired  bool
+	// Whether a server accepts anonymous authentication and whether the client was anonymous
+	allowAnonymous bool
+	anonymous      bool
+	// The responses that are sent and accepted, nil when the session sends and accepts those of its NTLM version
+	lmCompatibilityLevel *LmCompatibilityLevel
 
 	NegotiateFlags uint32
+	// The flags agreed with the server, NegotiateFlags may be adjusted afterwards for the key calculation
+	negotiatedFlags uint32
+
+	// The flags this side is willing to negotiate, zero means the default set for the NTLM version is used, and the
+	// flags that must be agreed with the peer
+	supportedFlags uint32
+	requiredFlags  uint32
+
+	// The identity advertised by a server in the challenge message and by a client in the negotiate and authenticate messages
+	serverInfo *ServerInfo
+	clientInfo *ClientInfo
 
 	negotiateMessage    *messages.Negotiate
 	challengeMessage    *messages.Challenge
@@ -124,4 +206,309 @@ type SessionData struct {
 
 	clientHandle *rc4P.Cipher
 	serverHandle *rc4P.Cipher
+
+	// Sequence numbers for connection oriented NTLM, one for each direction
+	clientSeqNum uint32
+	serverSeqNum uint32
+}
+
+// Set the negotiate flags the session is willing to use, by default a set suitable for the NTLM version is used
+func (n *SessionData) SetSupportedFlags(flags uint32) {
+	n.supportedFlags = flags
+}
+
+// Set the negotiate flags that must be agreed with the peer, for example NTLMSSP_NEGOTIATE_128 or NTLMSSP_NEGOTIATE_SEAL.
+// The handshake fails when one of them can not be negotiated.
+func (n *SessionData) SetRequiredFlags(flags uint32) {
+	n.requiredFlags = flags
+}
+
+// Returned when the timestamp of an NTLMv2 response is outside the allowed clock skew
+var ErrStaleResponse = newAuthenticationError("NTLMv2 response timestamp is outside the allowed clock skew")
+
+// Set how far the timestamp of an NTLMv2 response may be from the server time, responses outside of this window are
+// rejected with ErrStaleResponse. Zero, the default, disables the check. NTLMv1 responses carry no timestamp.
+func (n *SessionData) SetMaxClockSkew(skew time.Duration) {
+	n.maxClockSkew = skew
+}
+
+// Set the code page of the OEM strings the session sends and receives, code page 437 is used by default. OEM strings
+// are used by clients that do not negotiate Unicode.
+func (n *SessionData) SetOemCodePage(codePage *messages.CodePage) {
+	n.oemCodePage = codePage
+}
+
+// The string of a message payload, OEM strings are decoded with the code page of the session when one is set and with
+// the code page they were parsed with otherwise
+func (n *SessionData) payloadString(p *messages.PayloadStruct) string {
+	if p.Type == messages.OemStringPayload && n.oemCodePage != nil {
+		return n.oemCodePage.Decode(p.Payload)
+	}
+	return p.String()
+}
+
+// In connection oriented NTLM (NTLMSSP_NEGOTIATE_DATAGRAM not negotiated) the sequence number is maintained by the
+// session and incremented for every message signed or verified in that direction. In connectionless NTLM the
+// application supplied sequence number is used.
+func (n *SessionData) nextSequenceNumber(seqNum *uint32, sequenceNumber int) int {
+	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(n.NegotiateFlags) {
+		return sequenceNumber
+	}
+	current := *seqNum
+	*seqNum = current + 1
+	return int(current)
+}
+
+// Connectionless NTLM is requested with NTLMSSP_NEGOTIATE_DATAGRAM, connection oriented NTLM must not set it
+func (n *SessionData) modeFlags(flags uint32) uint32 {
+	if n.mode == ConnectionlessMode {
+		flags = messages.NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
+	} else {
+		flags = messages.NTLMSSP_NEGOTIATE_DATAGRAM.Unset(flags)
+	}
+	return flags
+}
+
+// The flags this side of the session offers to the peer, required flags are always offered
+func (n *SessionData) offeredFlags(defaultFlags uint32) uint32 {
+	flags := defaultFlags
+	if n.supportedFlags != 0 {
+		flags = n.supportedFlags
+	}
+	return n.modeFlags(flags | n.requiredFlags)
+}
+
+// These flags are chosen by the server and returned in the challenge message whatever the client requested
+const serverChosenFlags = uint32(messages.NTLMSSP_NEGOTIATE_NTLM | messages.NTLMSSP_NEGOTIATE_TARGET_INFO | messages.NTLMSSP_NEGOTIATE_VERSION)
+
+// Work out the flags a server returns in the challenge message. Without a negotiate message (connectionless NTLM)
+// the server offers everything it supports and the client makes the choice.
+func (n *SessionData) negotiateServerFlags(offered uint32) (uint32, error) {
+	if n.negotiateMessage == nil {
+		return n.negotiateFlags(offered, offered)
+	}
+	return n.negotiateFlags(n.negotiateMessage.NegotiateFlags|(offered&serverChosenFlags), offered)
+}
+
+// Intersect the flags requested by the peer with the flags offered by this side, following the precedence rules of
+// MS-NLMP, and make sure the required flags survived
+func (n *SessionData) negotiateFlags(requested, offered uint32) (flags uint32, err error) {
+	flags = requested & offered
+
+	// NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY alone is used when both it and NTLMSSP_NEGOTIATE_LM_KEY are agreed
+	if messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(flags) {
+		flags = messages.NTLMSSP_NEGOTIATE_LM_KEY.Unset(flags)
+	}
+
+	// Unicode is preferred over OEM but one of them has to be agreed
+	if messages.NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) {
+		flags = messages.NTLM_NEGOTIATE_OEM.Unset(flags)
+	} else if !messages.NTLM_NEGOTIATE_OEM.IsSet(flags) {
+		return 0, errors.New("Could not negotiate a character set")
+	}
+
+	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(flags) && !messages.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(flags) {
+		return 0, errors.New("Connectionless NTLM requires NTLMSSP_NEGOTIATE_KEY_EXCH")
+	}
+
+	err = n.checkRequiredFlags(flags)
+	if err != nil {
+		return 0, err
+	}
+	return flags, nil
+}
+
+// Returns an error naming the required flags that are not set in flags
+func (n *SessionData) checkRequiredFlags(flags uint32) error {
+	missing := n.requiredFlags &^ flags
+	if missing == 0 {
+		return nil
+	}
+	return errors.New("Could not negotiate required flags: " + flagNames(missing))
+}
+
+// These flags are set by the client in the authenticate message without the server offering them
+const clientChosenFlags = uint32(messages.NTLMSSP_ANONYMOUS | messages.NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED | messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED)
+
+// Take the flags of the authenticate message, the client chooses from the flags the server offered in the challenge
+// message and may not add others that would change the keys or the mode of the session
+func (n *SessionData) acceptAuthenticateFlags(am *messages.Authenticate) error {
+	if n.challengeMessage != nil {
+		added := am.NegotiateFlags &^ (n.challengeMessage.NegotiateFlags | clientChosenFlags)
+		if added != 0 {
+			return newAuthenticationError("Authenticate message sets flags that were not offered: " + flagNames(added))
+		}
+	}
+	n.NegotiateFlags = am.NegotiateFlags
+	return n.checkRequiredFlags(n.NegotiateFlags)
+}
+
+// The names of the flags that are set, separated by commas
+func flagNames(flags uint32) string {
+	names := make([]string, 0)
+	for i := uint(0); i < 32; i++ {
+		flag := messages.NegotiateFlag(1 << i)
+		if flag.IsSet(flags) {
+			names = append(names, messages.GetFlagName(flag))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Build the NEGOTIATE_MESSAGE that a client sends to start the handshake, the domain is supplied when it is known and the
+// workstation when it is known and NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED is supported
+func (n *SessionData) newNegotiateMessage(flags uint32) *messages.Negotiate {
+	info := n.getClientInfo()
+
+	nm := new(messages.Negotiate)
+	nm.Signature = []byte("NTLMSSP\x00")
+	nm.MessageType = uint32(1)
+
+	if n.userDomain != "" {
+		flags = messages.NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.Set(flags)
+		nm.DomainNameFields, _ = messages.CreateOemStringPayload(n.userDomain, n.oemCodePage)
+	} else {
+		nm.DomainNameFields, _ = messages.CreateBytePayload(make([]byte, 0))
+	}
+	if messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.IsSet(flags) && info.Workstation != "" {
+		nm.WorkstationFields, _ = messages.CreateOemStringPayload(info.Workstation, n.oemCodePage)
+	} else {
+		flags = messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.Unset(flags)
+		nm.WorkstationFields, _ = messages.CreateBytePayload(make([]byte, 0))
+	}
+
+	nm.NegotiateFlags = flags
+	nm.Version = info.Version
+
+	n.negotiateMessage = nm
+	return nm
+}
+
+// Build the CHALLENGE_MESSAGE that a server sends in response to a negotiate message, a new server challenge is
+// generated for each message
+func (n *SessionData) newChallengeMessage(flags uint32) *messages.Challenge {
+	info := n.getServerInfo()
+
+	cm := new(messages.Challenge)
+	cm.Signature = []byte("NTLMSSP\x00")
+	cm.MessageType = uint32(2)
+
+	targetName, flags := info.targetName(flags)
+	if messages.NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) {
+		cm.TargetName, _ = messages.CreateStringPayload(targetName)
+	} else {
+		cm.TargetName, _ = messages.CreateOemStringPayload(targetName, n.oemCodePage)
+	}
+	cm.NegotiateFlags = flags
+
+	n.serverChallenge = n.newServerChallenge()
+	cm.ServerChallenge = n.serverChallenge
+	cm.Reserved = make([]byte, 8)
+
+	pairs := info.targetInfo()
+	pairs.SetTimestamp(time.Now())
+	cm.TargetInfo = pairs
+	cm.TargetInfoPayloadStruct, _ = messages.CreateBytePayload(pairs.Bytes())
+
+	cm.Version = info.Version
+
+	n.challengeMessage = cm
+	return cm
+}
+
+// Define MIC as HMAC_MD5(ExportedSessionKey, ConcatenationOf(NEGOTIATE_MESSAGE, CHALLENGE_MESSAGE, AUTHENTICATE_MESSAGE))
+// The messages are used as they were sent or received, with the MIC field of the AUTHENTICATE_MESSAGE set to zero.
+// In connectionless mode there is no NEGOTIATE_MESSAGE.
+func (n *SessionData) computeMic(am *messages.Authenticate) []byte {
+	var negotiateBytes, challengeBytes []byte
+	if n.negotiateMessage != nil {
+		negotiateBytes = n.negotiateMessage.RawBytes
+		if negotiateBytes == nil {
+			negotiateBytes = n.negotiateMessage.Bytes()
+		}
+	}
+	if n.challengeMessage != nil {
+		challengeBytes = n.challengeMessage.RawBytes
+		if challengeBytes == nil {
+			challengeBytes = n.challengeMessage.Bytes()
+		}
+	}
+	return hmacMd5(n.exportedSessionKey, concat(negotiateBytes, challengeBytes, am.BytesWithoutMic()))
+}
+
+// Returned when the MIC of the authenticate message is missing or does not match the messages of the handshake
+var ErrInvalidMic = newAuthenticationError("Invalid MIC, the authenticate message has been modified")
+
+// Returned when a client sends a MIC to a server that did not generate the challenge message. The MIC covers the
+// challenge message, so SetServerChallenge can not be used with clients that send one.
+var ErrMicWithoutChallenge = newAuthenticationError("Can not verify the MIC without the challenge message")
+
+// Check the MIC sent by the client, the server must have generated the challenge message for this to be possible
+func (n *SessionData) verifyMic(am *messages.Authenticate) error {
+	n.mic = am.Mic
+	if n.challengeMessage == nil {
+		return ErrMicWithoutChallenge
+	}
+	if len(am.Mic) != 16 || !hmacP.Equal(n.computeMic(am), am.Mic) {
+		return ErrInvalidMic
+	}
+	return nil
+}
+
+// Encrypt and sign a message using the handle, keys and sequence number for one direction of the session
+func (n *SessionData) sealMessage(handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey, message []byte, sequenceNumber int) ([]byte, []byte, error) {
+	err := n.checkKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !messages.NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) {
+		return nil, nil, errors.New("Message confidentiality (NTLMSSP_NEGOTIATE_SEAL) was not negotiated")
+	}
+	sequenceNumber = n.nextSequenceNumber(seqNum, sequenceNumber)
+	handle = messageHandle(n.NegotiateFlags, handle, sealingKey, sequenceNumber)
+	sealedMessage, sig := seal(n.NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
+	return sealedMessage, sig.Bytes(), nil
+}
+
+// Decrypt a message and verify its signature using the handle, keys and sequence number for one direction of the session
+func (n *SessionData) unsealMessage(handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey, sealedMessage, signature []byte, sequenceNumber int) ([]byte, bool, error) {
+	err := n.checkKeys()
+	if err != nil {
+		return nil, false, err
+	}
+	if !messages.NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) {
+		return nil, false, errors.New("Message confidentiality (NTLMSSP_NEGOTIATE_SEAL) was not negotiated")
+	}
+	sequenceNumber = n.nextSequenceNumber(seqNum, sequenceNumber)
+	handle = messageHandle(n.NegotiateFlags, handle, sealingKey, sequenceNumber)
+	message := rc4(handle, sealedMessage)
+	sig := mac(n.NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
+	return message, MacsEqual(sig.Bytes(), signature), nil
+}
+
+// Sign a message using the handle, keys and sequence number for one direction of the session
+func (n *SessionData) signMessage(handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey, message []byte, sequenceNumber int) ([]byte, error) {
+	err := n.checkKeys()
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber = n.nextSequenceNumber(seqNum, sequenceNumber)
+	handle = messageHandle(n.NegotiateFlags, handle, sealingKey, sequenceNumber)
+	return sign(n.NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message), nil
+}
+
+// Initialize the RC4 handles used for signing and sealing and reset the sequence numbers
+func (n *SessionData) initHandles() (err error) {
+	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	if err != nil {
+		return err
+	}
+	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+	if err != nil {
+		return err
+	}
+	n.clientSeqNum = 0
+	n.serverSeqNum = 0
+	n.logKeysDerived()
+	return nil
 }
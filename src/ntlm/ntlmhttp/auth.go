@@ -0,0 +1,99 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+// Package ntlmhttp performs NTLM authentication over HTTP, the messages of the handshake are sent base64 encoded in
+// the WWW-Authenticate and Authorization headers.
+package ntlmhttp
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	SchemeNTLM      = "NTLM"
+	SchemeNegotiate = "Negotiate"
+)
+
+// The status code that asks for authentication and the headers that carry the messages, they differ between a server
+// and a proxy
+type authHeaders struct {
+	status        int
+	authenticate  string
+	authorization string
+}
+
+var (
+	serverHeaders = authHeaders{status: http.StatusUnauthorized, authenticate: "WWW-Authenticate", authorization: "Authorization"}
+	proxyHeaders  = authHeaders{status: http.StatusProxyAuthRequired, authenticate: "Proxy-Authenticate", authorization: "Proxy-Authorization"}
+)
+
+// The challenges in the values of an authenticate header, a value can hold several challenges separated by commas.
+// Each challenge is split into the scheme and the token or parameters that follow it.
+func parseChallenges(values []string) [][2]string {
+	challenges := make([][2]string, 0)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			fields := strings.Fields(part)
+			if len(fields) == 0 {
+				continue
+			}
+			challenge := [2]string{fields[0], ""}
+			if len(fields) > 1 {
+				challenge[1] = fields[1]
+			}
+			challenges = append(challenges, challenge)
+		}
+	}
+	return challenges
+}
+
+// The scheme used for the handshake, NTLM is preferred when the peer offers it. A peer that only offers Negotiate
+// accepts NTLM messages in it. Empty when neither scheme is offered.
+func chooseScheme(values []string) string {
+	scheme := ""
+	for _, challenge := range parseChallenges(values) {
+		if strings.EqualFold(challenge[0], SchemeNTLM) {
+			return SchemeNTLM
+		}
+		if strings.EqualFold(challenge[0], SchemeNegotiate) {
+			scheme = SchemeNegotiate
+		}
+	}
+	return scheme
+}
+
+// The decoded token sent with the scheme, ok is false when the scheme has no valid token
+func challengeToken(values []string, scheme string) (token []byte, ok bool) {
+	for _, challenge := range parseChallenges(values) {
+		if strings.EqualFold(challenge[0], scheme) && challenge[1] != "" {
+			token, err := base64.StdEncoding.DecodeString(challenge[1])
+			if err != nil {
+				return nil, false
+			}
+			return token, true
+		}
+	}
+	return nil, false
+}
+
+// The value of an authorization header with a message of the handshake
+func authorization(scheme string, message []byte) string {
+	return scheme + " " + base64.StdEncoding.EncodeToString(message)
+}
+
+// The most of a body that is read to keep the connection for the next message of the handshake
+const maxDrainedBody = 1 << 20
+
+// Read what is left of the body and close it so the connection can be used for the next message of the handshake.
+// False is returned when the connection can not be used, because the response closes it or the body is too large to
+// read.
+func drainBody(resp *http.Response) bool {
+	if resp.Close {
+		resp.Body.Close()
+		return false
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainedBody+1))
+	resp.Body.Close()
+	return err == nil && n <= maxDrainedBody
+}
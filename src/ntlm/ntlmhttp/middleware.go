@@ -0,0 +1,227 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"ntlm"
+	"ntlm/messages"
+	"strings"
+	"sync"
+)
+
+// The identity of an authenticated connection, available to handlers with UserFromContext
+type User struct {
+	Name        string
+	Domain      string
+	Workstation string
+	Anonymous   bool
+}
+
+type userKey struct{}
+
+// The user that authenticated the connection of the request, ok is false when the request did not go through
+// Middleware.Handler
+func UserFromContext(ctx context.Context) (user *User, ok bool) {
+	user, ok = ctx.Value(userKey{}).(*User)
+	return user, ok
+}
+
+type connKey struct{}
+
+// The handshake state of one connection
+type connAuth struct {
+	mutex   sync.Mutex
+	session ntlm.ServerSession
+	user    *User
+}
+
+// Authenticates the connections of an http.Server with NTLM. NTLM authenticates a connection rather than a request, so
+// ConfigureServer must be called to track the handshake of each connection. Once a connection is authenticated its
+// requests are passed to the handler without further messages.
+type Middleware struct {
+	// Creates the server session for a handshake. When nil a session is created with CredentialStore that only accepts
+	// NTLMv2, at LmCompatibilityLevel5. Clients that still send NTLMv1 need a NewSession that sets a weaker level.
+	NewSession func(r *http.Request) (ntlm.ServerSession, error)
+	// Looks up the credentials of the users when NewSession is nil
+	CredentialStore ntlm.CredentialStore
+
+	// The handshake state of the open connections
+	mutex sync.Mutex
+	conns map[net.Conn]*connAuth
+}
+
+// Install the ConnContext and ConnState hooks that track the handshake of each connection, hooks that are already
+// set are still called
+func (m *Middleware) ConfigureServer(server *http.Server) {
+	connContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return m.ConnContext(ctx, c)
+	}
+	connState := server.ConnState
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		m.ConnState(c, state)
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+}
+
+// Start tracking the handshake of a new connection, for use as http.Server.ConnContext
+func (m *Middleware) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	conn := new(connAuth)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conns == nil {
+		m.conns = make(map[net.Conn]*connAuth)
+	}
+	m.conns[c] = conn
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// Forget the handshake and the user of a connection that is closed or hijacked, for use as http.Server.ConnState. A
+// hijacked connection is no longer an HTTP connection so it does not stay authenticated.
+func (m *Middleware) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	m.mutex.Lock()
+	conn := m.conns[c]
+	delete(m.conns, c)
+	m.mutex.Unlock()
+	if conn != nil {
+		conn.mutex.Lock()
+		conn.session = nil
+		conn.user = nil
+		conn.mutex.Unlock()
+	}
+}
+
+var errNoSession = errors.New("ntlmhttp: Middleware needs NewSession or CredentialStore")
+
+func (m *Middleware) newSession(r *http.Request) (ntlm.ServerSession, error) {
+	if m.NewSession != nil {
+		return m.NewSession(r)
+	}
+	if m.CredentialStore == nil {
+		return nil, errNoSession
+	}
+	session, err := ntlm.CreateServerSession(ntlm.VersionAuto, ntlm.ConnectionOrientedMode)
+	if err != nil {
+		return nil, err
+	}
+	session.SetCredentialStore(m.CredentialStore)
+	session.SetLmCompatibilityLevel(ntlm.LmCompatibilityLevel5)
+	return session, nil
+}
+
+// Wrap a handler so that it only receives requests on authenticated connections, with the User in the context
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connKey{}).(*connAuth)
+		if !ok {
+			http.Error(w, "ntlmhttp: Middleware.ConfigureServer was not called", http.StatusInternalServerError)
+			return
+		}
+		conn.mutex.Lock()
+		user, err := m.authenticate(w, r, conn)
+		conn.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+		}
+	})
+}
+
+// Take the handshake of the connection a step further. The user is returned once the connection is authenticated,
+// until then the response is written here.
+func (m *Middleware) authenticate(w http.ResponseWriter, r *http.Request, conn *connAuth) (*User, error) {
+	scheme, token, ok := authorizationToken(r.Header.Get("Authorization"))
+	if !ok {
+		if conn.user != nil {
+			return conn.user, nil
+		}
+		unauthorized(w, SchemeNTLM, nil)
+		return nil, nil
+	}
+
+	// A negotiate message starts a new handshake, also on a connection that is already authenticated
+	if len(token) >= 12 && token[8] == 1 {
+		conn.user = nil
+		conn.session = nil
+		negotiate, err := messages.ParseNegotiateMessage(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil
+		}
+		session, err := m.newSession(r)
+		if err != nil {
+			return nil, err
+		}
+		err = session.ProcessNegotiateMessage(negotiate)
+		if err != nil {
+			unauthorized(w, SchemeNTLM, nil)
+			return nil, nil
+		}
+		challenge, err := session.GenerateChallengeMessage()
+		if err != nil {
+			unauthorized(w, SchemeNTLM, nil)
+			return nil, nil
+		}
+		conn.session = session
+		unauthorized(w, scheme, challenge.Bytes())
+		return nil, nil
+	}
+
+	session := conn.session
+	conn.session = nil
+	if session == nil {
+		unauthorized(w, SchemeNTLM, nil)
+		return nil, nil
+	}
+	authenticate, err := messages.ParseAuthenticateMessage(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	err = session.ProcessAuthenticateMessage(authenticate)
+	if err != nil {
+		unauthorized(w, SchemeNTLM, nil)
+		return nil, nil
+	}
+	name, _, domain := session.GetUserInfo()
+	conn.user = &User{Name: name, Domain: domain, Workstation: session.GetWorkstation(), Anonymous: session.IsAnonymous()}
+	return conn.user, nil
+}
+
+// The scheme and decoded token of an Authorization header with an NTLM message, ok is false for other headers
+func authorizationToken(header string) (scheme string, token []byte, ok bool) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 || !(strings.EqualFold(fields[0], SchemeNTLM) || strings.EqualFold(fields[0], SchemeNegotiate)) {
+		return "", nil, false
+	}
+	token, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", nil, false
+	}
+	return fields[0], token, true
+}
+
+// Answer 401 with the scheme, and the challenge message when there is one
+func unauthorized(w http.ResponseWriter, scheme string, challenge []byte) {
+	if challenge == nil {
+		w.Header().Set("WWW-Authenticate", scheme)
+	} else {
+		w.Header().Set("WWW-Authenticate", authorization(scheme, challenge))
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,159 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"ntlm"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A server behind the middleware that answers with the user in the context
+func newMiddlewareServer(m *Middleware, requests *int32) *httptest.Server {
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", user.Name, user.Domain, user.Workstation)
+	}))
+	server := httptest.NewUnstartedServer(handler)
+	m.ConfigureServer(server.Config)
+	server.Start()
+	return server
+}
+
+// A client transport whose sessions send the workstation WS01
+func newClientTransport(password string) *Transport {
+	return &Transport{NewSession: func(req *http.Request) (ntlm.ClientSession, error) {
+		session, err := ntlm.CreateClientSession(ntlm.Version2, ntlm.ConnectionOrientedMode)
+		if err != nil {
+			return nil, err
+		}
+		session.SetUserInfo("User", password, "Domain")
+		session.SetClientInfo(ntlm.ClientInfo{Workstation: "WS01"})
+		return session, nil
+	}}
+}
+
+func TestMiddleware(t *testing.T) {
+	store := ntlm.NewMemoryCredentialStore()
+	store.AddPassword("User", "Domain", "Password")
+	sessions := int32(0)
+	m := &Middleware{NewSession: func(r *http.Request) (ntlm.ServerSession, error) {
+		atomic.AddInt32(&sessions, 1)
+		session, err := ntlm.CreateServerSession(ntlm.VersionAuto, ntlm.ConnectionOrientedMode)
+		if err != nil {
+			return nil, err
+		}
+		session.SetCredentialStore(store)
+		return session, nil
+	}}
+	requests := int32(0)
+	server := newMiddlewareServer(m, &requests)
+	defer server.Close()
+
+	// Requests without NTLM are refused
+	plainTransport := new(http.Transport)
+	plain := &http.Client{Transport: plainTransport}
+	resp, err := plain.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "NTLM" || requests != 0 {
+		t.Errorf("Expected 401 with WWW-Authenticate: NTLM but got %d %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	transport := newClientTransport("Password")
+	client := &http.Client{Transport: transport}
+	status, body := get(t, client, server.URL)
+	if status != http.StatusOK || body != "User Domain WS01" {
+		t.Fatalf("Expected 200 User Domain WS01 but got %d %s", status, body)
+	}
+
+	// The connection stays authenticated, another connection is not
+	status, _ = get(t, client, server.URL)
+	if status != http.StatusOK || sessions != 1 || requests != 2 {
+		t.Errorf("Expected a second request without a handshake but got %d after %d handshakes", status, sessions)
+	}
+	resp, err = plain.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on a new connection but got %d", resp.StatusCode)
+	}
+
+	// The state of a closed connection is dropped
+	transport.CloseIdleConnections()
+	plainTransport.CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mutex.Lock()
+		open := len(m.conns)
+		m.mutex.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the closed connections to be forgotten but %d remain", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client = &http.Client{Transport: newClientTransport("Wrong password")}
+	status, _ = get(t, client, server.URL)
+	if status != http.StatusUnauthorized || requests != 2 {
+		t.Errorf("Expected 401 for the wrong password but got %d", status)
+	}
+}
+
+func TestMiddlewareNeedsConfigureServer(t *testing.T) {
+	m := &Middleware{CredentialStore: ntlm.NewMemoryCredentialStore()}
+	server := httptest.NewServer(m.Handler(http.NotFoundHandler()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500 without ConfigureServer but got %d", resp.StatusCode)
+	}
+}
+
+func TestMiddlewareDefaultSession(t *testing.T) {
+	store := ntlm.NewMemoryCredentialStore()
+	store.AddPassword("User", "Domain", "Password")
+	requests := int32(0)
+	server := newMiddlewareServer(&Middleware{CredentialStore: store}, &requests)
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	status, _ := get(t, client, server.URL)
+	if status != http.StatusOK {
+		t.Errorf("Expected 200 for NTLMv2 but got %d", status)
+	}
+
+	// NTLMv1 is refused at LmCompatibilityLevel5
+	v1 := &Transport{NewSession: func(req *http.Request) (ntlm.ClientSession, error) {
+		session, err := ntlm.CreateClientSession(ntlm.Version1, ntlm.ConnectionOrientedMode)
+		if err != nil {
+			return nil, err
+		}
+		session.SetUserInfo("User", "Password", "Domain")
+		return session, nil
+	}}
+	status, _ = get(t, &http.Client{Transport: v1}, server.URL)
+	if status != http.StatusUnauthorized || requests != 1 {
+		t.Errorf("Expected 401 for NTLMv1 but got %d", status)
+	}
+}
@@ -0,0 +1,236 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"ntlm"
+	"ntlm/messages"
+	"time"
+)
+
+// Dials connections through an HTTP proxy with CONNECT. When the proxy answers 407 and offers NTLM or Negotiate the
+// handshake is made on the connection to the proxy before the tunnel is established. Use DialContext as the
+// DialContext of an http.Transport without a Proxy, HTTPS requests then run TLS through the tunnel.
+type ProxyDialer struct {
+	// The proxy, http://host:port or https://host:port
+	ProxyURL *url.URL
+
+	User     string
+	Password string
+	Domain   string
+
+	// Creates the client session for the handshake with the proxy. When nil an NTLMv2 session is created with the user,
+	// password and domain above and the target name HTTP/<proxy host>.
+	NewSession func() (ntlm.ClientSession, error)
+
+	// Dials the connection to the proxy, a net.Dialer is used when nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// The TLS configuration for an https proxy
+	TLSClientConfig *tls.Config
+}
+
+func (d *ProxyDialer) newSession() (ntlm.ClientSession, error) {
+	if d.NewSession != nil {
+		return d.NewSession()
+	}
+	return newClientSession(d.User, d.Password, d.Domain, d.ProxyURL.Hostname())
+}
+
+// The host and port of the proxy, the port defaults to that of the scheme
+func (d *ProxyDialer) proxyAddress() string {
+	port := d.ProxyURL.Port()
+	if port == "" {
+		port = "80"
+		if d.ProxyURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(d.ProxyURL.Hostname(), port)
+}
+
+// Open a connection to the proxy
+func (d *ProxyDialer) dialProxy(ctx context.Context) (*proxyConn, error) {
+	dial := d.Dial
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	conn, err := dial(ctx, "tcp", d.proxyAddress())
+	if err != nil {
+		return nil, err
+	}
+	// The deadline and cancellation of the context apply to the whole handshake, until the tunnel is established
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	if d.ProxyURL.Scheme == "https" {
+		config := d.TLSClientConfig.Clone()
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName = d.ProxyURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			stop()
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), ctx: ctx, stop: stop}, nil
+}
+
+// Open a tunnel to addr through the proxy, authenticating to the proxy with NTLM when it asks for it
+func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.ProxyURL == nil {
+		return nil, errors.New("ntlmhttp: ProxyDialer needs ProxyURL")
+	}
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.connect(addr, "")
+	if err != nil {
+		return nil, conn.fail(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return conn.tunnel()
+	}
+	scheme := chooseScheme(resp.Header.Values(proxyHeaders.authenticate))
+	if resp.StatusCode != http.StatusProxyAuthRequired || scheme == "" {
+		return nil, conn.fail(errors.New("Proxy refused CONNECT: " + resp.Status))
+	}
+
+	// The handshake needs a connection that stays open, the first answer may close it
+	if resp.Close {
+		err = conn.fail(nil)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = d.dialProxy(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = d.handshake(conn, addr, scheme)
+	if err != nil {
+		return nil, conn.fail(err)
+	}
+	return conn.tunnel()
+}
+
+// Make the NTLM handshake with CONNECT requests on the connection, nil is returned once the proxy opened the tunnel
+func (d *ProxyDialer) handshake(conn *proxyConn, addr string, scheme string) error {
+	session, err := d.newSession()
+	if err != nil {
+		return err
+	}
+	negotiate, err := session.GenerateNegotiateMessage()
+	if err != nil {
+		return err
+	}
+	resp, err := conn.connect(addr, authorization(scheme, negotiate.Bytes()))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	token, ok := challengeToken(resp.Header.Values(proxyHeaders.authenticate), scheme)
+	if resp.StatusCode != http.StatusProxyAuthRequired || !ok || resp.Close {
+		return errors.New("Proxy did not send an NTLM challenge: " + resp.Status)
+	}
+
+	challenge, err := messages.ParseChallengeMessage(token)
+	if err != nil {
+		return err
+	}
+	err = session.ProcessChallengeMessage(challenge)
+	if err != nil {
+		return err
+	}
+	authenticate, err := session.GenerateAuthenticateMessage()
+	if err != nil {
+		return err
+	}
+	resp, err = conn.connect(addr, authorization(scheme, authenticate.Bytes()))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Proxy refused CONNECT: " + resp.Status)
+	}
+	return nil
+}
+
+// A connection to the proxy, the responses to CONNECT are read through reader
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// The context of the dial and the function that stops it from ending the handshake
+	ctx  context.Context
+	stop func() bool
+}
+
+// Send a CONNECT request for addr with the Proxy-Authorization header when it is given. The body of a response that
+// refuses the tunnel is read so the next request can be sent on the connection.
+func (c *proxyConn) connect(addr string, proxyAuthorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyAuthorization != "" {
+		req.Header.Set(proxyHeaders.authorization, proxyAuthorization)
+	}
+	err := req.Write(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		return nil, err
+	}
+	// A body that ends with the connection, or is too large to read, leaves no connection for the next request
+	if resp.StatusCode != http.StatusOK && !resp.Close {
+		resp.Close = !drainBody(resp)
+	}
+	return resp, nil
+}
+
+// The established tunnel, data the proxy sent after its response is read first. The context no longer applies to it.
+func (c *proxyConn) tunnel() (net.Conn, error) {
+	if !c.stop() {
+		return nil, c.fail(nil)
+	}
+	c.Conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Close a connection the handshake could not use. The error of the context is returned when it ended the handshake,
+// err otherwise.
+func (c *proxyConn) fail(err error) error {
+	c.stop()
+	c.Conn.Close()
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
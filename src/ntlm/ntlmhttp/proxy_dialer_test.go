@@ -0,0 +1,186 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ntlm"
+	"ntlm/messages"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A proxy that authenticates its connections with NTLM, it opens CONNECT tunnels and forwards plain HTTP requests
+type fakeProxy struct {
+	*httptest.Server
+	url *url.URL
+
+	mutex      sync.Mutex
+	handshakes int
+}
+
+func newFakeProxy() *fakeProxy {
+	p := new(fakeProxy)
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(p.serveHTTP))
+	p.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, testConnKey{}, new(testConn))
+	}
+	p.Start()
+	p.url, _ = url.Parse(p.URL)
+	return p
+}
+
+func proxyAuthRequired(w http.ResponseWriter, value string) {
+	w.Header().Set("Proxy-Authenticate", value)
+	w.WriteHeader(http.StatusProxyAuthRequired)
+}
+
+func (p *fakeProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(testConnKey{}).(*testConn)
+	if conn.user == "" {
+		fields := strings.Fields(r.Header.Get("Proxy-Authorization"))
+		if len(fields) != 2 {
+			proxyAuthRequired(w, "NTLM")
+			return
+		}
+		token, _ := base64.StdEncoding.DecodeString(fields[1])
+		if negotiate, err := messages.ParseNegotiateMessage(token); err == nil {
+			conn.session, _ = ntlm.CreateServerSession(ntlm.VersionAuto, ntlm.ConnectionOrientedMode)
+			conn.session.SetUserInfo("User", "Password", "Domain")
+			conn.session.ProcessNegotiateMessage(negotiate)
+			challenge, _ := conn.session.GenerateChallengeMessage()
+			proxyAuthRequired(w, authorization(fields[0], challenge.Bytes()))
+			return
+		}
+		authenticate, err := messages.ParseAuthenticateMessage(token)
+		if err != nil || conn.session == nil || conn.session.ProcessAuthenticateMessage(authenticate) != nil {
+			proxyAuthRequired(w, "NTLM")
+			return
+		}
+		conn.user, _, _ = conn.session.GetUserInfo()
+		p.mutex.Lock()
+		p.handshakes++
+		p.mutex.Unlock()
+	}
+
+	if r.Method == "CONNECT" {
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		client, buffered, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(target, buffered)
+			target.Close()
+		}()
+		io.Copy(client, target)
+		client.Close()
+		return
+	}
+
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func TestProxyDialer(t *testing.T) {
+	proxy := newFakeProxy()
+	defer proxy.Close()
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer target.Close()
+
+	dialer := &ProxyDialer{ProxyURL: proxy.url, User: "User", Password: "Password", Domain: "Domain"}
+	transport := target.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	client := &http.Client{Transport: transport}
+	status, body := get(t, client, target.URL)
+	if status != http.StatusOK || body != "tunneled" || proxy.handshakes != 1 {
+		t.Errorf("Expected 200 tunneled after one handshake but got %d %s after %d", status, body, proxy.handshakes)
+	}
+
+	dialer = &ProxyDialer{ProxyURL: proxy.url, User: "User", Password: "Wrong password", Domain: "Domain"}
+	transport = target.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	_, err := (&http.Client{Transport: transport}).Get(target.URL)
+	if err == nil || !strings.Contains(err.Error(), "Proxy refused CONNECT: 407") {
+		t.Errorf("Expected the proxy to refuse the wrong password but got %v", err)
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	proxy := newFakeProxy()
+	defer proxy.Close()
+	// The server behind the proxy asks for NTLM as well
+	server := newTestServer("NTLM")
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy.url)},
+		User:      "User",
+		Password:  "Password",
+		Domain:    "Domain",
+	}}
+	status, body := get(t, client, server.URL)
+	if status != http.StatusOK || body != "User" || proxy.handshakes != 1 || server.handshakes != 1 {
+		t.Errorf("Expected 200 User after a handshake with the proxy and the server but got %d %s after %d and %d", status, body, proxy.handshakes, server.handshakes)
+	}
+}
+
+func TestProxyDialerContext(t *testing.T) {
+	// A proxy that asks for NTLM and then stops sending in the middle of the body
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 100\r\n\r\npartial")
+		}
+	}()
+
+	dialer := &ProxyDialer{ProxyURL: &url.URL{Scheme: "http", Host: listener.Addr().String()}, User: "User", Password: "Password", Domain: "Domain"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = dialer.DialContext(ctx, "tcp", "www.example.com:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline of the context to end the handshake but got %v", err)
+	}
+
+	// Cancelling the context ends the handshake as well
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = dialer.DialContext(ctx, "tcp", "www.example.com:443")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled context to end the handshake but got %v", err)
+	}
+}
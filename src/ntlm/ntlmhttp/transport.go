@@ -0,0 +1,301 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"ntlm"
+	"ntlm/messages"
+	"sync"
+)
+
+// An http.RoundTripper that authenticates with NTLM when a server answers 401, or a proxy answers 407, and offers the
+// NTLM or Negotiate scheme. NTLM authenticates a connection rather than a request, so each request is sent through a
+// clone of the underlying http.Transport limited to one connection. The messages of a handshake go over that
+// connection and no other request uses it until the response body is closed, then the connection is kept for the next
+// request to the host. Request bodies are replayed for every message. A proxy is only authenticated for plain HTTP
+// requests, HTTPS requests through a proxy need ProxyDialer.
+type Transport struct {
+	// The transport that sends the requests. When nil a clone of http.DefaultTransport is used, connections
+	// authenticated for this user are not shared with other transports. A RoundTripper that is not an http.Transport
+	// can not be limited to one connection, it must send the messages of a handshake over the same connection itself.
+	Transport http.RoundTripper
+
+	User     string
+	Password string
+	Domain   string
+
+	// Creates the client session for a handshake with the server of the request or the proxy, when nil an NTLMv2 session
+	// is created with the user, password and domain above and the target name HTTP/<host of the server or proxy>
+	NewSession func(req *http.Request) (ntlm.ClientSession, error)
+
+	// The idle single connection transports by scheme and host
+	mutex sync.Mutex
+	idle  map[string][]*http.Transport
+
+	defaultTransportOnce sync.Once
+	defaultTransport     http.RoundTripper
+}
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport != nil {
+		return t.Transport
+	}
+	t.defaultTransportOnce.Do(func() {
+		t.defaultTransport = http.DefaultTransport.(*http.Transport).Clone()
+	})
+	return t.defaultTransport
+}
+
+// The transport for one request to the host with the key, an idle one when there is one. A clone of an
+// http.Transport is limited to one connection so the messages of a handshake can not go over different connections.
+func (t *Transport) getConn(key string) http.RoundTripper {
+	base, ok := t.transport().(*http.Transport)
+	if !ok {
+		return t.transport()
+	}
+	t.mutex.Lock()
+	idle := t.idle[key]
+	if len(idle) > 0 {
+		conn := idle[len(idle)-1]
+		t.idle[key] = idle[:len(idle)-1]
+		t.mutex.Unlock()
+		return conn
+	}
+	t.mutex.Unlock()
+	conn := base.Clone()
+	conn.MaxConnsPerHost = 1
+	conn.MaxIdleConnsPerHost = 1
+	// NTLM authenticates an HTTP/1.1 connection, servers such as IIS refuse the handshake over HTTP/2
+	conn.ForceAttemptHTTP2 = false
+	conn.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	if conn.TLSClientConfig != nil {
+		protos := make([]string, 0, len(conn.TLSClientConfig.NextProtos))
+		for _, proto := range conn.TLSClientConfig.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		conn.TLSClientConfig.NextProtos = protos
+	}
+	return conn
+}
+
+// Give back the transport of a request once its response is read, up to MaxIdleConnsPerHost of the underlying
+// transport are kept for the host and the connections of the others are closed
+func (t *Transport) putConn(key string, conn http.RoundTripper) {
+	pinned, ok := conn.(*http.Transport)
+	if !ok {
+		return
+	}
+	max := t.transport().(*http.Transport).MaxIdleConnsPerHost
+	if max <= 0 {
+		max = http.DefaultMaxIdleConnsPerHost
+	}
+	t.mutex.Lock()
+	if len(t.idle[key]) < max {
+		if t.idle == nil {
+			t.idle = make(map[string][]*http.Transport)
+		}
+		t.idle[key] = append(t.idle[key], pinned)
+		t.mutex.Unlock()
+		return
+	}
+	t.mutex.Unlock()
+	pinned.CloseIdleConnections()
+}
+
+// Close the idle connections, those of the underlying transport as well
+func (t *Transport) CloseIdleConnections() {
+	t.mutex.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mutex.Unlock()
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.CloseIdleConnections()
+		}
+	}
+	if transport, ok := t.transport().(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (t *Transport) newSession(req *http.Request, host string) (ntlm.ClientSession, error) {
+	if t.NewSession != nil {
+		return t.NewSession(req)
+	}
+	return newClientSession(t.User, t.Password, t.Domain, host)
+}
+
+// An NTLMv2 session for the user that names the host in its target name
+func newClientSession(user, password, domain, host string) (ntlm.ClientSession, error) {
+	session, err := ntlm.CreateClientSession(ntlm.Version2, ntlm.ConnectionOrientedMode)
+	if err != nil {
+		return nil, err
+	}
+	session.SetUserInfo(user, password, domain)
+	if host != "" {
+		session.SetTargetName("HTTP/"+host, false)
+	}
+	return session, nil
+}
+
+// The host of the proxy the request is sent through, empty when it is not known
+func (t *Transport) proxyHost(req *http.Request) string {
+	transport, ok := t.transport().(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return ""
+	}
+	proxy, err := transport.Proxy(req)
+	if err != nil || proxy == nil {
+		return ""
+	}
+	return proxy.Hostname()
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := replayableBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.URL.Scheme + "://" + req.URL.Host
+	conn := t.getConn(key)
+	resp, err := t.roundTrip(conn, req, body)
+	if err != nil {
+		if pinned, ok := conn.(*http.Transport); ok {
+			pinned.CloseIdleConnections()
+		}
+		return nil, err
+	}
+	// A connection that switched protocols is no longer HTTP and is not given back
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { t.putConn(key, conn) }}
+	}
+	return resp, nil
+}
+
+func (t *Transport) roundTrip(conn http.RoundTripper, req *http.Request, body func() (io.ReadCloser, error)) (*http.Response, error) {
+	resp, err := send(conn, req, body, "", "")
+	if err != nil {
+		return nil, err
+	}
+	// The proxy has to let the request through before the server can ask for authentication
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		resp, err = t.authenticate(conn, req, body, resp, proxyHeaders, t.proxyHost(req))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return t.authenticate(conn, req, body, resp, serverHeaders, req.URL.Hostname())
+	}
+	return resp, nil
+}
+
+// Answer a response that asks for authentication with a handshake on the connection of conn, the response is returned
+// as it is when it does not offer NTLM or Negotiate
+func (t *Transport) authenticate(conn http.RoundTripper, req *http.Request, body func() (io.ReadCloser, error), resp *http.Response, headers authHeaders, host string) (*http.Response, error) {
+	scheme := chooseScheme(resp.Header.Values(headers.authenticate))
+	if scheme == "" {
+		return resp, nil
+	}
+	// When the connection of the response is not kept the negotiate message goes over a new one, the handshake only
+	// needs the same connection from there on
+	drainBody(resp)
+
+	session, err := t.newSession(req, host)
+	if err != nil {
+		return nil, err
+	}
+	return handshake(conn, req, body, session, scheme, headers)
+}
+
+// A response body that gives the transport of the request back once it is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Send the negotiate message and answer the challenge with the authenticate message. The response to the
+// authenticate message is returned, or an earlier response that is not a challenge.
+func handshake(transport http.RoundTripper, req *http.Request, body func() (io.ReadCloser, error), session ntlm.ClientSession, scheme string, headers authHeaders) (*http.Response, error) {
+	negotiate, err := session.GenerateNegotiateMessage()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := send(transport, req, body, headers.authorization, authorization(scheme, negotiate.Bytes()))
+	if err != nil || resp.StatusCode != headers.status {
+		return resp, err
+	}
+	token, ok := challengeToken(resp.Header.Values(headers.authenticate), scheme)
+	if !ok {
+		return resp, nil
+	}
+	if !drainBody(resp) {
+		return nil, errChallengeConnection
+	}
+
+	challenge, err := messages.ParseChallengeMessage(token)
+	if err != nil {
+		return nil, err
+	}
+	err = session.ProcessChallengeMessage(challenge)
+	if err != nil {
+		return nil, err
+	}
+	authenticate, err := session.GenerateAuthenticateMessage()
+	if err != nil {
+		return nil, err
+	}
+	return send(transport, req, body, headers.authorization, authorization(scheme, authenticate.Bytes()))
+}
+
+var errChallengeConnection = errors.New("ntlmhttp: the connection was closed after the challenge, the handshake can not be completed")
+
+// Send a copy of the request with a new copy of the body, and the header when it is given
+func send(transport http.RoundTripper, req *http.Request, body func() (io.ReadCloser, error), header, value string) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if body != nil {
+		var err error
+		out.Body, err = body()
+		if err != nil {
+			return nil, err
+		}
+		out.GetBody = body
+	}
+	if header != "" {
+		out.Header.Set(header, value)
+	}
+	return transport.RoundTrip(out)
+}
+
+// Returns a function that gives a new copy of the body of the request each time it is sent, nil when there is no
+// body. A body without GetBody is read into memory. The body of the request itself is closed.
+func replayableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.New("Could not read the request body: " + err.Error())
+	}
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, nil
+}
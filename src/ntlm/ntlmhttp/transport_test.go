@@ -0,0 +1,284 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlmhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ntlm"
+	"ntlm/messages"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testConnKey struct{}
+
+// The handshake state of one connection to the test server
+type testConn struct {
+	session ntlm.ServerSession
+	user    string
+}
+
+// A server that authenticates connections with NTLM, offering the given schemes, and records what it received
+type testServer struct {
+	*httptest.Server
+	schemes []string
+	// Close the connection after the first 401 or after the challenge
+	closeUnauthorized bool
+	closeChallenge    bool
+
+	mutex      sync.Mutex
+	bodies     []string
+	usedScheme string
+	handshakes int
+}
+
+func newTestServer(schemes ...string) *testServer {
+	s := newUnstartedTestServer(schemes...)
+	s.Start()
+	return s
+}
+
+func newUnstartedTestServer(schemes ...string) *testServer {
+	s := &testServer{schemes: schemes}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, testConnKey{}, new(testConn))
+	}
+	return s
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(testConnKey{}).(*testConn)
+	// Like IIS, NTLM is only accepted over HTTP/1.1
+	if r.ProtoMajor != 1 {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.mutex.Lock()
+	s.bodies = append(s.bodies, string(body))
+	s.mutex.Unlock()
+
+	if conn.user != "" {
+		io.WriteString(w, conn.user)
+		return
+	}
+
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 {
+		for _, scheme := range s.schemes {
+			w.Header().Add("WWW-Authenticate", scheme)
+		}
+		if s.closeUnauthorized {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	scheme := fields[0]
+	token, _ := base64.StdEncoding.DecodeString(fields[1])
+	if len(token) < 12 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch token[8] {
+	case 1:
+		negotiate, err := messages.ParseNegotiateMessage(token)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn.session, _ = ntlm.CreateServerSession(ntlm.VersionAuto, ntlm.ConnectionOrientedMode)
+		conn.session.SetUserInfo("User", "Password", "Domain")
+		conn.session.ProcessNegotiateMessage(negotiate)
+		challenge, _ := conn.session.GenerateChallengeMessage()
+		w.Header().Set("WWW-Authenticate", authorization(scheme, challenge.Bytes()))
+		if s.closeChallenge {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	case 3:
+		authenticate, err := messages.ParseAuthenticateMessage(token)
+		// The authenticate message must arrive on the connection that received the negotiate message
+		if err != nil || conn.session == nil || conn.session.ProcessAuthenticateMessage(authenticate) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn.user, _, _ = conn.session.GetUserInfo()
+		s.mutex.Lock()
+		s.usedScheme = scheme
+		s.handshakes++
+		s.mutex.Unlock()
+		io.WriteString(w, conn.user)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestTransport(t *testing.T) {
+	server := newTestServer("NTLM")
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	status, body := get(t, client, server.URL)
+	if status != http.StatusOK || body != "User" {
+		t.Fatalf("Expected 200 User but got %d %s", status, body)
+	}
+
+	// The connection stays authenticated
+	status, body = get(t, client, server.URL)
+	if status != http.StatusOK || body != "User" || server.handshakes != 1 {
+		t.Errorf("Expected a second request without a handshake but got %d %s after %d handshakes", status, body, server.handshakes)
+	}
+
+	client = &http.Client{Transport: &Transport{User: "User", Password: "Wrong password", Domain: "Domain"}}
+	status, _ = get(t, client, server.URL)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the wrong password but got %d", status)
+	}
+}
+
+// A client session that takes its time to answer the challenge, the connection of the handshake is idle meanwhile
+type slowSession struct {
+	ntlm.ClientSession
+}
+
+func (s slowSession) GenerateAuthenticateMessage() (*messages.Authenticate, error) {
+	time.Sleep(20 * time.Millisecond)
+	return s.ClientSession.GenerateAuthenticateMessage()
+}
+
+func TestTransportConcurrentHandshakes(t *testing.T) {
+	server := newTestServer("NTLM")
+	defer server.Close()
+
+	// Every handshake keeps its connection while the others start
+	client := &http.Client{Transport: &Transport{NewSession: func(req *http.Request) (ntlm.ClientSession, error) {
+		session, err := newClientSession("User", "Password", "Domain", "")
+		return slowSession{session}, err
+	}}}
+	var wait sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wait.Wait()
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("Request %d: expected 200 but got %d", i, status)
+		}
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	server := newUnstartedTestServer("NTLM")
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// The client of the server offers HTTP/2, the handshake still goes over HTTP/1.1
+	client := &http.Client{Transport: &Transport{Transport: server.Client().Transport, User: "User", Password: "Password", Domain: "Domain"}}
+	status, body := get(t, client, server.URL)
+	if status != http.StatusOK || body != "User" {
+		t.Errorf("Expected 200 User but got %d %s", status, body)
+	}
+}
+
+func TestTransportClosedConnection(t *testing.T) {
+	// The handshake starts on a new connection when the first one is closed
+	server := newTestServer("NTLM")
+	server.closeUnauthorized = true
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	status, _ := get(t, client, server.URL)
+	if status != http.StatusOK {
+		t.Errorf("Expected 200 after the first connection was closed but got %d", status)
+	}
+
+	// The authenticate message can not go over another connection than the challenge
+	server = newTestServer("NTLM")
+	server.closeChallenge = true
+	defer server.Close()
+	client = &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, errChallengeConnection) {
+		t.Errorf("Expected errChallengeConnection but got %v", err)
+	}
+}
+
+func TestTransportReplaysBody(t *testing.T) {
+	server := newTestServer("NTLM")
+	defer server.Close()
+
+	// A reader that http.NewRequest does not know, so the request has no GetBody
+	req, _ := http.NewRequest("POST", server.URL, io.MultiReader(strings.NewReader("pay"), strings.NewReader("load")))
+	client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", resp.StatusCode)
+	}
+	if strings.Join(server.bodies, ",") != "payload,payload,payload" {
+		t.Errorf("Expected the body with every message but the server received %q", server.bodies)
+	}
+}
+
+func TestTransportSchemes(t *testing.T) {
+	for _, test := range []struct {
+		offered  []string
+		expected string
+	}{
+		{[]string{"Negotiate", "NTLM"}, "NTLM"},
+		{[]string{"Basic realm=\"test\", Negotiate"}, "Negotiate"},
+		{[]string{"negotiate"}, "negotiate"},
+	} {
+		server := newTestServer(test.offered...)
+		client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+		status, _ := get(t, client, server.URL)
+		if status != http.StatusOK || !strings.EqualFold(server.usedScheme, test.expected) {
+			t.Errorf("Offering %q: expected 200 with %s but got %d with %s", test.offered, test.expected, status, server.usedScheme)
+		}
+		server.Close()
+	}
+
+	// A server that does not offer NTLM gets the request as it is
+	server := newTestServer("Basic realm=\"test\"")
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{User: "User", Password: "Password", Domain: "Domain"}}
+	status, _ := get(t, client, server.URL)
+	if status != http.StatusUnauthorized || len(server.bodies) != 1 {
+		t.Errorf("Expected a single request answered with 401 but got %d after %d requests", status, len(server.bodies))
+	}
+}
@@ -4,11 +4,11 @@ package ntlm
 
 import (
 	"bytes"
-	l4g "code.google.com/p/log4go"
 	rc4P "crypto/rc4"
 	"errors"
 	"ntlm/messages"
 	"strings"
+	"sync"
 )
 
 /*******************************
@@ -17,12 +17,15 @@ import (
 
 type V1Session struct {
 	SessionData
+	// Held by the handshake methods and while signing and sealing, the session can be shared by goroutines
+	mutex sync.Mutex
 }
 
 func (n *V1Session) SetUserInfo(username string, password string, domain string) {
 	n.user = username
 	n.password = password
 	n.userDomain = domain
+	n.credential = nil
 }
 
 func (n *V1Session) GetUserInfo() (string, string, string) {
@@ -38,11 +41,16 @@ func (n *V1Session) Version() int {
 }
 
 func (n *V1Session) fetchResponseKeys() (err error) {
-	n.responseKeyLM, err = lmowfv1(n.password)
+	credential, err := n.fetchCredential()
 	if err != nil {
 		return err
 	}
-	n.responseKeyNT = ntowfv1(n.password)
+	// The LM hash is nil when only the NT hash of the password is known
+	n.responseKeyLM, err = credential.lmHash()
+	if err != nil {
+		return err
+	}
+	n.responseKeyNT = credential.ntHash()
 	return
 }
 
@@ -62,7 +70,7 @@ func (n *V1Session) computeExpectedResponses() (err error) {
 		// response to the server challenge when NTLMv1 authentication is used.<30>
 		// <30> Section 3.1.1.1: The default value of this state variable is TRUE. Windows NT Server 4.0 SP3
 		// does not support providing NTLM instead of LM responses.
-		noLmResponseNtlmV1 := false
+		noLmResponseNtlmV1 := n.responseKeyLM == nil
 		if noLmResponseNtlmV1 {
 			n.lmChallengeResponse = n.ntChallengeResponse
 		} else {
@@ -84,6 +92,8 @@ func (n *V1Session) computeSessionBaseKey() (err error) {
 func (n *V1Session) computeKeyExchangeKey() (err error) {
 	if messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) {
 		n.keyExchangeKey = hmacMd5(n.sessionBaseKey, concat(n.serverChallenge, n.lmChallengeResponse[0:8]))
+	} else if n.responseKeyLM == nil && (messages.NTLMSSP_NEGOTIATE_LM_KEY.IsSet(n.NegotiateFlags) || messages.NTLMSSP_REQUEST_NON_NT_SESSION_KEY.IsSet(n.NegotiateFlags)) {
+		err = errors.New("The LM session key can not be computed without the LM hash")
 	} else {
 		n.keyExchangeKey, err = kxKey(n.NegotiateFlags, n.sessionBaseKey, n.lmChallengeResponse, n.serverChallenge, n.responseKeyLM)
 	}
@@ -106,47 +116,96 @@ func (n *V1Session) calculateKeys(ntlmRevisionCurrent uint8) (err error) {
 	return
 }
 
-func (n *V1Session) Seal(message []byte) ([]byte, error) {
-	return nil, nil
-}
-
-func (n *V1Session) Sign(message []byte) ([]byte, error) {
-	return nil, nil
-}
-
 func ntlmV1Mac(message []byte, sequenceNumber int, handle *rc4P.Cipher, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
+	handle = messageHandle(NegotiateFlags, handle, sealingKey, sequenceNumber)
 	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
 	return sig.Bytes()
 }
 
 func (n *V1ServerSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.serverSeqNum, sequenceNumber)
 	mac := ntlmV1Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
 	return mac, nil
 }
 
-func (n *V1ClientSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
+func (n *V1ServerSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return false, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.clientSeqNum, sequenceNumber)
 	mac := ntlmV1Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return mac, nil
+	return MacsEqual(mac, expectedMac), nil
 }
 
-func (n *V1ServerSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
+func (n *V1ClientSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.clientSeqNum, sequenceNumber)
 	mac := ntlmV1Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return MacsEqual(mac, expectedMac), nil
+	return mac, nil
 }
 
 func (n *V1ClientSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return false, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.serverSeqNum, sequenceNumber)
 	mac := ntlmV1Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
 	return MacsEqual(mac, expectedMac), nil
 }
 
+func (n *V1ServerSession) Seal(message []byte, sequenceNumber int) ([]byte, []byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.sealMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, message, sequenceNumber)
+}
+
+func (n *V1ClientSession) Seal(message []byte, sequenceNumber int) ([]byte, []byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.sealMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, message, sequenceNumber)
+}
+
+func (n *V1ServerSession) Unseal(sealedMessage, signature []byte, sequenceNumber int) ([]byte, bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.unsealMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, sealedMessage, signature, sequenceNumber)
+}
+
+func (n *V1ClientSession) Unseal(sealedMessage, signature []byte, sequenceNumber int) ([]byte, bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.unsealMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, sealedMessage, signature, sequenceNumber)
+}
+
+func (n *V1ServerSession) Sign(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.signMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, message, sequenceNumber)
+}
+
+func (n *V1ClientSession) Sign(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.signMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, message, sequenceNumber)
+}
+
 /**************
  Server Session
 **************/
@@ -156,17 +215,43 @@ type V1ServerSession struct {
 }
 
 func (n *V1ServerSession) ProcessNegotiateMessage(nm *messages.Negotiate) (err error) {
-	n.negotiateMessage = nm
-	return
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.processNegotiateMessage(nm)
+}
+
+// The flags the server supports unless SetSupportedFlags is used
+func (n *V1ServerSession) serverFlags() uint32 {
+	flags := uint32(0)
+	flags = messages.NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_VERSION.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_LM_KEY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_TARGET_INFO.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_NTLM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SEAL.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = messages.NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = messages.NTLM_NEGOTIATE_OEM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_128.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_56.Set(flags)
+
+	return n.offeredFlags(flags)
 }
 
 func (n *V1ServerSession) GenerateChallengeMessage() (cm *messages.Challenge, err error) {
-	// TODO: Generate this challenge message
-	return
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.generateChallengeMessage(n.serverFlags())
 }
 
 func (n *V1ServerSession) SetServerChallenge(challenge []byte) {
-	n.serverChallenge = challenge
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.setServerChallenge(challenge)
 }
 
 func (n *V1ServerSession) GetSessionData() *SessionData {
@@ -174,15 +259,47 @@ func (n *V1ServerSession) GetSessionData() *SessionData {
 }
 
 func (n *V1ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err = n.checkState(stateChallenged)
+	if err != nil {
+		return err
+	}
+	err = n.advance(stateAuthenticated, n.processAuthenticateMessage(am))
+	n.logAuthenticateResult(n.Version(), err)
+	return err
+}
+
+func (n *V1ServerSession) processAuthenticateMessage(am *messages.Authenticate) (err error) {
 	n.authenticateMessage = am
-	n.NegotiateFlags = am.NegotiateFlags
+	err = n.acceptAuthenticateFlags(am)
+	if err != nil {
+		return err
+	}
 	n.clientChallenge = am.ClientChallenge()
 	n.encryptedRandomSessionKey = am.EncryptedRandomSessionKey.Payload
 	// Ignore the values used in SetUserInfo and use these instead from the authenticate message
 	// They should always be correct (I hope)
-	n.user = am.UserName.String()
-	n.userDomain = am.DomainName.String()
-	l4g.Info("(ProcessAuthenticateMessage)NTLM v1 User %s Domain %s", n.user, n.userDomain)
+	n.user = n.payloadString(am.UserName)
+	n.userDomain = n.payloadString(am.DomainName)
+
+	// A challenge can only be answered once, whether or not the answer is correct
+	err = n.useServerChallenge()
+	if err != nil {
+		return err
+	}
+
+	if isAnonymousAuthenticate(am) {
+		return n.processAnonymousAuthenticate(am)
+	}
+
+	if n.refusesNtlmV1Response() {
+		return ErrLmCompatibilityLevel
+	}
+
+	if am.NtlmV1Response == nil {
+		return newMalformedMessageError("Authenticate message does not contain an NTLMv1 response")
+	}
 
 	err = n.fetchResponseKeys()
 	if err != nil {
@@ -204,30 +321,50 @@ func (n *V1ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate)
 		return err
 	}
 
+	// With extended session security the expected LM response is made from the client challenge in the LM response
+	// itself, it proves nothing and only the NT response is accepted
 	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
-		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
-			return errors.New("Could not authenticate")
+		if n.refusesLmResponse() || messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) || !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
+			return ErrAuthenticationFailed
 		}
 	}
 
-	n.mic = am.Mic
-	am.Mic = zeroBytes(16)
+	// NTLMv1 responses can not carry channel bindings or a target name
+	err = n.verifyChannelBindings(nil)
+	if err != nil {
+		return err
+	}
 
-	err = n.computeExportedSessionKey()
+	err = n.verifyTargetName(nil)
 	if err != nil {
 		return err
 	}
 
-	err = n.calculateKeys(am.Version.NTLMRevisionCurrent)
+	err = n.useResponse(concat(am.LmChallengeResponse.Payload, am.NtChallengeResponseFields.Payload))
 	if err != nil {
 		return err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	err = n.computeExportedSessionKey()
 	if err != nil {
 		return err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+
+	// NTLMv1 responses have no MsvAvFlags to signal that a MIC is present, and older clients send none or a zero one.
+	// A MIC that the client filled in is checked.
+	if am.Mic != nil && !bytes.Equal(am.Mic, zeroBytes(16)) {
+		err = n.verifyMic(am)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = n.calculateKeys(am.Version.NtlmRevision())
+	if err != nil {
+		return err
+	}
+
+	err = n.initHandles()
 	if err != nil {
 		return err
 	}
@@ -235,18 +372,37 @@ func (n *V1ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate)
 	return nil
 }
 
+// Finish an anonymous authentication, the keys are derived from the zero session base key
+func (n *V1ServerSession) processAnonymousAuthenticate(am *messages.Authenticate) (err error) {
+	err = n.acceptAnonymous()
+	if err != nil {
+		return err
+	}
+
+	err = n.computeExportedSessionKey()
+	if err != nil {
+		return err
+	}
+
+	err = n.calculateKeys(am.Version.NtlmRevision())
+	if err != nil {
+		return err
+	}
+
+	return n.initHandles()
+}
+
 func (n *V1ServerSession) computeExportedSessionKey() (err error) {
 	if messages.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags) {
+		if len(n.encryptedRandomSessionKey) != 16 {
+			return newMalformedMessageError("Invalid encrypted random session key")
+		}
 		n.exportedSessionKey, err = rc4K(n.keyExchangeKey, n.encryptedRandomSessionKey)
 		if err != nil {
 			return err
 		}
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.exportedSessionKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	} else {
 		n.exportedSessionKey = n.keyExchangeKey
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.keyExchangeKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	}
 	return nil
 }
@@ -259,17 +415,8 @@ type V1ClientSession struct {
 	V1Session
 }
 
-func (n *V1ClientSession) GenerateNegotiateMessage() (nm *messages.Negotiate, err error) {
-	return nil, nil
-}
-
-func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err error) {
-	n.challengeMessage = cm
-	n.serverChallenge = cm.ServerChallenge
-	n.clientChallenge = randomBytes(8)
-
-	// Set up the default flags for processing the response. These are the flags that we will return
-	// in the authenticate message
+// The flags the client requests in the negotiate message unless SetSupportedFlags is used
+func (n *V1ClientSession) clientFlags() uint32 {
 	flags := uint32(0)
 	flags = messages.NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
 	// NOTE: Unsetting this flag in order to get the server to generate the signatures we can recognize
@@ -279,12 +426,58 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 	flags = messages.NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_NTLM.Set(flags)
-	flags = messages.NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SEAL.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_SIGN.Set(flags)
 	flags = messages.NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = messages.NTLM_NEGOTIATE_OEM.Set(flags)
 
-	n.NegotiateFlags = flags
+	return n.clientLevelFlags(n.offeredFlags(flags))
+}
+
+func (n *V1ClientSession) GenerateNegotiateMessage() (nm *messages.Negotiate, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	// The negotiate message may be generated again until a challenge has been processed
+	err = n.checkState(stateInitial, stateNegotiated)
+	if err != nil {
+		return nil, err
+	}
+	err = n.advance(stateNegotiated, n.checkClientVersion(Version1))
+	if err != nil {
+		return nil, err
+	}
+	return n.newNegotiateMessage(n.clientFlags()), nil
+}
+
+func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	// The negotiate message is not sent in connectionless mode
+	err = n.checkState(stateInitial, stateNegotiated)
+	if err != nil {
+		return err
+	}
+	return n.advance(stateChallenged, n.processChallengeMessage(cm))
+}
+
+func (n *V1ClientSession) processChallengeMessage(cm *messages.Challenge) (err error) {
+	err = n.checkClientVersion(Version1)
+	if err != nil {
+		return err
+	}
+
+	n.challengeMessage = cm
+	n.serverChallenge = cm.ServerChallenge
+	n.clientChallenge = randomBytes(8)
+
+	// These are the flags that we will return in the authenticate message, what the server offered and we support
+	n.negotiatedFlags, err = n.negotiateFlags(cm.NegotiateFlags, n.clientFlags())
+	if err != nil {
+		return err
+	}
+	n.NegotiateFlags = n.negotiatedFlags
 
 	err = n.fetchResponseKeys()
 	if err != nil {
@@ -295,6 +488,10 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 	if err != nil {
 		return err
 	}
+	// From level 2 the client does not send the LM response, a server still accepts it up to level 3
+	if n.noLmResponse() && !messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) {
+		n.lmChallengeResponse = n.ntChallengeResponse
+	}
 
 	err = n.computeSessionBaseKey()
 	if err != nil {
@@ -306,21 +503,21 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 		return err
 	}
 
-	err = n.computeEncryptedSessionKey()
-	if err != nil {
-		return err
+	if n.anonymousClient() {
+		n.computeAnonymousResponses()
 	}
 
-	err = n.calculateKeys(cm.Version.NTLMRevisionCurrent)
+	err = n.computeEncryptedSessionKey()
 	if err != nil {
 		return err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	err = n.calculateKeys(cm.Version.NtlmRevision())
 	if err != nil {
 		return err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+
+	err = n.initHandles()
 	if err != nil {
 		return err
 	}
@@ -329,17 +526,29 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 }
 
 func (n *V1ClientSession) GenerateAuthenticateMessage() (am *messages.Authenticate, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err = n.checkState(stateChallenged)
+	if err != nil {
+		return nil, err
+	}
+	n.state = stateAuthenticated
+
 	am = new(messages.Authenticate)
 	am.Signature = []byte("NTLMSSP\x00")
 	am.MessageType = uint32(3)
 	am.LmChallengeResponse, _ = messages.CreateBytePayload(n.lmChallengeResponse)
 	am.NtChallengeResponseFields, _ = messages.CreateBytePayload(n.ntChallengeResponse)
-	am.DomainName, _ = messages.CreateStringPayload(n.userDomain)
-	am.UserName, _ = messages.CreateStringPayload(n.user)
-	am.Workstation, _ = messages.CreateStringPayload("SQUAREMILL")
+	am.DomainName, _ = messages.CreateNegotiatedStringPayload(n.userDomain, n.negotiatedFlags, n.oemCodePage)
+	am.UserName, _ = messages.CreateNegotiatedStringPayload(n.user, n.negotiatedFlags, n.oemCodePage)
+	am.Workstation, _ = messages.CreateNegotiatedStringPayload(n.getClientInfo().Workstation, n.negotiatedFlags, n.oemCodePage)
 	am.EncryptedRandomSessionKey, _ = messages.CreateBytePayload(n.encryptedRandomSessionKey)
-	am.NegotiateFlags = n.NegotiateFlags
-	am.Version = &messages.VersionStruct{ProductMajorVersion: uint8(5), ProductMinorVersion: uint8(1), ProductBuild: uint16(2600), NTLMRevisionCurrent: uint8(15)}
+	am.NegotiateFlags = n.negotiatedFlags
+	am.Version = n.getClientInfo().Version
+	// An anonymous client has no key to protect the messages with
+	if !n.anonymousClient() {
+		am.Mic = n.computeMic(am)
+	}
 	return am, nil
 }
 
@@ -351,7 +560,9 @@ func (n *V1ClientSession) computeEncryptedSessionKey() (err error) {
 			return err
 		}
 	} else {
-		n.encryptedRandomSessionKey = n.keyExchangeKey
+		// Without key exchange the key exchange key is used directly and no session key is sent
+		n.exportedSessionKey = n.keyExchangeKey
+		n.encryptedRandomSessionKey = make([]byte, 0)
 	}
 	return nil
 }
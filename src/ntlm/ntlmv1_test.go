@@ -4,6 +4,7 @@ package ntlm
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"ntlm/messages"
 	"testing"
 )
@@ -110,7 +111,7 @@ func TestNtlmV1(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033820a820123456789abcdef00000000000000000000000000000000060070170000000f530065007200760065007200")
 	challengeMessage, err := messages.ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -125,16 +126,16 @@ func TestNtlmV1(t *testing.T) {
 	server := new(V1ServerSession)
 	server.SetUserInfo("User", "Password", "Domain")
 	authenticateMessageBytes, err := hex.DecodeString("4e544c4d5353500003000000180018006c00000018001800840000000c000c00480000000800080054000000100010005c000000100010009c000000358280e20501280a0000000f44006f006d00610069006e00550073006500720043004f004d005000550054004500520098def7b87f88aa5dafe2df779688a172def11c7d5ccdef1367c43011f30298a2ad35ece64f16331c44bdbed927841f94518822b1b3f350c8958682ecbb3e3cb7")
-	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes, 1)
+	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
 
 	server = new(V1ServerSession)
 	server.SetUserInfo("User", "Password", "Domain")
-	server.serverChallenge = challengeMessage.ServerChallenge
+	server.SetServerChallenge(challengeMessage.ServerChallenge)
 
 	err = server.ProcessAuthenticateMessage(authenticateMessage)
 	if err != nil {
@@ -175,7 +176,7 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033820a820123456789abcdef00000000000000000000000000000000060070170000000f530065007200760065007200")
 	challengeMessage, err := messages.ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -189,12 +190,12 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 
 	server := new(V1ServerSession)
 	server.SetUserInfo("User", "Password", "Domain")
-	server.serverChallenge = challengeMessage.ServerChallenge
+	server.SetServerChallenge(challengeMessage.ServerChallenge)
 
 	authenticateMessageBytes, _ := hex.DecodeString("4e544c4d5353500003000000180018006c00000018001800840000000c000c00480000000800080054000000100010005c000000000000009c000000358208820501280a0000000f44006f006d00610069006e00550073006500720043004f004d0050005500540045005200aaaaaaaaaaaaaaaa000000000000000000000000000000007537f803ae367128ca458204bde7caf81e97ed2683267232")
-	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes, 1)
+	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
@@ -207,3 +208,90 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 	checkV1Value(t, "SealKey", server.ClientSealingKey, "04dd7f014d8504d265a25cc86a3a7c06", nil)
 	checkV1Value(t, "SignKey", server.ClientSigningKey, "60e799be5c72fc92922ae8ebe961fb8d", nil)
 }
+
+func TestNTLMv1Handshake(t *testing.T) {
+	for _, mode := range []Mode{ConnectionlessMode, ConnectionOrientedMode} {
+		client, server := newTestSessions(t, Version1, mode)
+		runHandshake(t, client, server)
+
+		if !messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(server.GetSessionData().NegotiateFlags) {
+			t.Error("Extended session security should have been negotiated")
+		}
+
+		checkSealUnseal(t, client, server, 3)
+	}
+}
+
+func TestNTLMv1ChallengeWithoutExtendedSessionSecurity(t *testing.T) {
+	negotiate := new(messages.Negotiate)
+	negotiate.NegotiateFlags = messages.NTLMSSP_NEGOTIATE_LM_KEY.Set(messages.NTLMSSP_NEGOTIATE_NTLM.Set(messages.NTLMSSP_NEGOTIATE_UNICODE.Set(0)))
+
+	server, _ := CreateServerSession(Version1, ConnectionOrientedMode)
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+
+	if messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(challenge.NegotiateFlags) {
+		t.Error("Extended session security should not be offered when the client did not request it")
+	}
+	if !messages.NTLMSSP_NEGOTIATE_LM_KEY.IsSet(challenge.NegotiateFlags) || !messages.NTLMSSP_NEGOTIATE_NTLM.IsSet(challenge.NegotiateFlags) {
+		t.Error("NTLMv1 challenge flags are not correct")
+	}
+	if len(challenge.ServerChallenge) != 8 || challenge.TargetInfo == nil {
+		t.Error("NTLMv1 challenge message is not complete")
+	}
+}
+
+func TestNTLMv1Mic(t *testing.T) {
+	client, server := newTestSessions(t, Version1, ConnectionOrientedMode)
+	if runTamperedHandshake(t, client, server) == nil {
+		t.Error("Server accepted an authenticate message with modified flags")
+	}
+}
+
+// Run a handshake where the authenticate message is changed by tamper before the server parses it
+func tamperedHandshakeError(client ClientSession, server ServerSession, tamper func(authenticate []byte)) error {
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	challenge, _ = messages.ParseChallengeMessage(challenge.Bytes())
+	err := client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		return err
+	}
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticateBytes := authenticate.Bytes()
+	tamper(authenticateBytes)
+	authenticate, err = messages.ParseAuthenticateMessage(authenticateBytes)
+	if err != nil {
+		return err
+	}
+	return server.ProcessAuthenticateMessage(authenticate)
+}
+
+func TestNTLMv1ZeroMic(t *testing.T) {
+	// The MIC follows the fixed fields and the version
+	zeroMic := func(authenticate []byte) {
+		copy(authenticate[72:88], zeroBytes(16))
+	}
+
+	// Clients that do not send a MIC are accepted, the password is still checked
+	for _, version := range []Version{Version1, VersionAuto} {
+		server := newTestServer(t, version, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		client := newTestClient(t, Version1, ConnectionOrientedMode)
+		if err := tamperedHandshakeError(client, server, zeroMic); err != nil {
+			t.Errorf("Version %d: expected a zero MIC to be accepted but got %v", version, err)
+		}
+
+		server = newTestServer(t, version, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		client = newTestClient(t, Version1, ConnectionOrientedMode)
+		client.SetUserInfo("User", "Wrong password", "Domain")
+		if err := tamperedHandshakeError(client, server, zeroMic); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Version %d: expected the wrong password to fail authentication with a zero MIC but got %v", version, err)
+		}
+	}
+}
@@ -4,12 +4,10 @@ package ntlm
 
 import (
 	"bytes"
-	l4g "code.google.com/p/log4go"
 	rc4P "crypto/rc4"
-	"encoding/binary"
-	"errors"
 	"ntlm/messages"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,12 +17,15 @@ import (
 
 type V2Session struct {
 	SessionData
+	// Held by the handshake methods and while signing and sealing, the session can be shared by goroutines
+	mutex sync.Mutex
 }
 
 func (n *V2Session) SetUserInfo(username string, password string, domain string) {
 	n.user = username
 	n.password = password
 	n.userDomain = domain
+	n.credential = nil
 }
 
 func (n *V2Session) GetUserInfo() (string, string, string) {
@@ -40,10 +41,13 @@ func (n *V2Session) Version() int {
 }
 
 func (n *V2Session) fetchResponseKeys() (err error) {
-	// Usually at this point we'd go out to Active Directory and get these keys
-	// Here we are assuming we have the information locally
-	n.responseKeyLM = lmowfv2(n.user, n.password, n.userDomain)
-	n.responseKeyNT = ntowfv2(n.user, n.password, n.userDomain)
+	// The credential comes from the credential store on a server, otherwise from SetUserInfo
+	credential, err := n.fetchCredential()
+	if err != nil {
+		return err
+	}
+	n.responseKeyNT = ntowfv2Hash(n.user, credential.ntHash(), n.userDomain)
+	n.responseKeyLM = n.responseKeyNT
 	return
 }
 
@@ -83,61 +87,104 @@ func (n *V2Session) calculateKeys(ntlmRevisionCurrent uint8) (err error) {
 	return
 }
 
-func (n *V2Session) Seal(message []byte) ([]byte, error) {
-	return nil, nil
-}
-func (n *V2Session) Sign(message []byte) ([]byte, error) {
-	return nil, nil
-}
-
 //Mildly ghetto that we expose this
 func NtlmVCommonMac(message []byte, sequenceNumber int, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
 	var handle *rc4P.Cipher
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
+	handle = messageHandle(NegotiateFlags, handle, sealingKey, sequenceNumber)
 	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
 	return sig.Bytes()
 }
 
 func NtlmV2Mac(message []byte, sequenceNumber int, handle *rc4P.Cipher, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
+	handle = messageHandle(NegotiateFlags, handle, sealingKey, sequenceNumber)
 	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
 	return sig.Bytes()
 }
 
 func (n *V2ServerSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.serverSeqNum, sequenceNumber)
 	mac := NtlmV2Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
 	return mac, nil
 }
 
 func (n *V2ServerSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return false, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.clientSeqNum, sequenceNumber)
 	mac := NtlmV2Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
 	return MacsEqual(mac, expectedMac), nil
 }
 
 func (n *V2ClientSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.clientSeqNum, sequenceNumber)
 	mac := NtlmV2Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
 	return mac, nil
 }
 
 func (n *V2ClientSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err := n.checkKeys()
+	if err != nil {
+		return false, err
+	}
+	sequenceNumber = n.nextSequenceNumber(&n.serverSeqNum, sequenceNumber)
 	mac := NtlmV2Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
 	return MacsEqual(mac, expectedMac), nil
 }
 
+func (n *V2ServerSession) Seal(message []byte, sequenceNumber int) ([]byte, []byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.sealMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, message, sequenceNumber)
+}
+
+func (n *V2ClientSession) Seal(message []byte, sequenceNumber int) ([]byte, []byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.sealMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, message, sequenceNumber)
+}
+
+func (n *V2ServerSession) Unseal(sealedMessage, signature []byte, sequenceNumber int) ([]byte, bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.unsealMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, sealedMessage, signature, sequenceNumber)
+}
+
+func (n *V2ClientSession) Unseal(sealedMessage, signature []byte, sequenceNumber int) ([]byte, bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.unsealMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, sealedMessage, signature, sequenceNumber)
+}
+
+func (n *V2ServerSession) Sign(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.signMessage(n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey, message, sequenceNumber)
+}
+
+func (n *V2ClientSession) Sign(message []byte, sequenceNumber int) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.signMessage(n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey, message, sequenceNumber)
+}
+
 /**************
  Server Session
 **************/
@@ -147,20 +194,19 @@ type V2ServerSession struct {
 }
 
 func (n *V2ServerSession) SetServerChallenge(challenge []byte) {
-	n.serverChallenge = challenge
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.setServerChallenge(challenge)
 }
 
 func (n *V2ServerSession) ProcessNegotiateMessage(nm *messages.Negotiate) (err error) {
-	n.negotiateMessage = nm
-	return
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.processNegotiateMessage(nm)
 }
 
-func (n *V2ServerSession) GenerateChallengeMessage() (cm *messages.Challenge, err error) {
-	cm = new(messages.Challenge)
-	cm.Signature = []byte("NTLMSSP\x00")
-	cm.MessageType = uint32(2)
-	cm.TargetName, _ = messages.CreateBytePayload(make([]byte, 0))
-
+// The flags the server supports unless SetSupportedFlags is used
+func (n *V2ServerSession) serverFlags() uint32 {
 	flags := uint32(0)
 	flags = messages.NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_VERSION.Set(flags)
@@ -169,43 +215,60 @@ func (n *V2ServerSession) GenerateChallengeMessage() (cm *messages.Challenge, er
 	flags = messages.NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_NTLM.Set(flags)
-	flags = messages.NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SEAL.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_SIGN.Set(flags)
 	flags = messages.NTLMSSP_REQUEST_TARGET.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = messages.NTLM_NEGOTIATE_OEM.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_128.Set(flags)
 
-	cm.NegotiateFlags = flags
-
-	n.serverChallenge = randomBytes(8)
-	cm.ServerChallenge = n.serverChallenge
-	cm.Reserved = make([]byte, 8)
-
-	// Create the AvPairs we need
-	pairs := new(messages.AvPairs)
-	pairs.AddAvPair(messages.MsvAvNbDomainName, messages.StringToUtf16("REUTERS"))
-	pairs.AddAvPair(messages.MsvAvNbComputerName, messages.StringToUtf16("UKBP-CBTRMFE06"))
-	pairs.AddAvPair(messages.MsvAvDnsDomainName, messages.StringToUtf16("Reuters.net"))
-	pairs.AddAvPair(messages.MsvAvDnsComputerName, messages.StringToUtf16("ukbp-cbtrmfe06.Reuters.net"))
-	pairs.AddAvPair(messages.MsvAvDnsTreeName, messages.StringToUtf16("Reuters.net"))
-	pairs.AddAvPair(messages.MsvAvEOL, make([]byte, 0))
-	cm.TargetInfo = pairs
-	cm.TargetInfoPayloadStruct, _ = messages.CreateBytePayload(pairs.Bytes())
+	return n.offeredFlags(flags)
+}
 
-	cm.Version = &messages.VersionStruct{ProductMajorVersion: uint8(5), ProductMinorVersion: uint8(1), ProductBuild: uint16(2600), NTLMRevisionCurrent: uint8(15)}
-	return cm, nil
+func (n *V2ServerSession) GenerateChallengeMessage() (cm *messages.Challenge, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.generateChallengeMessage(n.serverFlags())
 }
 
 func (n *V2ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err = n.checkState(stateChallenged)
+	if err != nil {
+		return err
+	}
+	err = n.advance(stateAuthenticated, n.processAuthenticateMessage(am))
+	n.logAuthenticateResult(n.Version(), err)
+	return err
+}
+
+func (n *V2ServerSession) processAuthenticateMessage(am *messages.Authenticate) (err error) {
 	n.authenticateMessage = am
-	n.NegotiateFlags = am.NegotiateFlags
+	err = n.acceptAuthenticateFlags(am)
+	if err != nil {
+		return err
+	}
 	n.clientChallenge = am.ClientChallenge()
 	n.encryptedRandomSessionKey = am.EncryptedRandomSessionKey.Payload
 	// Ignore the values used in SetUserInfo and use these instead from the authenticate message
 	// They should always be correct (I hope)
-	n.user = am.UserName.String()
-	n.userDomain = am.DomainName.String()
-	l4g.Info("(ProcessAuthenticateMessage)NTLM v2 User %s Domain %s", n.user, n.userDomain)
+	n.user = n.payloadString(am.UserName)
+	n.userDomain = n.payloadString(am.DomainName)
+
+	// A challenge can only be answered once, whether or not the answer is correct
+	err = n.useServerChallenge()
+	if err != nil {
+		return err
+	}
+
+	if isAnonymousAuthenticate(am) {
+		return n.processAnonymousAuthenticate(am)
+	}
+
+	if am.NtlmV2Response == nil {
+		return newMalformedMessageError("Authenticate message does not contain an NTLMv2 response")
+	}
 
 	err = n.fetchResponseKeys()
 	if err != nil {
@@ -221,34 +284,61 @@ func (n *V2ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate)
 	}
 
 	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
-		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
-			return errors.New("Could not authenticate")
+		// The LMv2 response carries no timestamp so it is not accepted when the timestamp has to be checked
+		if n.maxClockSkew > 0 || !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
+			return ErrAuthenticationFailed
 		}
 	}
 
-	err = n.computeKeyExchangeKey()
+	// The timestamp is protected by the NTProofStr, an old one means the response has been captured and replayed
+	if n.maxClockSkew > 0 {
+		skew := time.Now().Sub(messages.FileTimeToTime(timestamp))
+		if skew > n.maxClockSkew || skew < -n.maxClockSkew {
+			return ErrStaleResponse
+		}
+	}
+
+	err = n.verifyChannelBindings(am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs)
 	if err != nil {
 		return err
 	}
 
-	n.mic = am.Mic
-	am.Mic = zeroBytes(16)
+	err = n.verifyTargetName(am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs)
+	if err != nil {
+		return err
+	}
 
-	err = n.computeExportedSessionKey()
+	// The NTProofStr is unique for every response
+	err = n.useResponse(n.ntChallengeResponse[0:16])
+	if err != nil {
+		return err
+	}
+
+	err = n.computeKeyExchangeKey()
 	if err != nil {
 		return err
 	}
 
-	err = n.calculateKeys(am.Version.NTLMRevisionCurrent)
+	err = n.computeExportedSessionKey()
 	if err != nil {
 		return err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	// The client sets the MsvAvFlags MIC bit in its AvPairs when it provides a MIC. The AvPairs are protected by
+	// the NTProofStr so the bit can not be removed without failing authentication.
+	if am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.Flags()&messages.MsvAvFlagMICProvided != 0 {
+		err = n.verifyMic(am)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = n.calculateKeys(am.Version.NtlmRevision())
 	if err != nil {
 		return err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+
+	err = n.initHandles()
 	if err != nil {
 		return err
 	}
@@ -256,18 +346,37 @@ func (n *V2ServerSession) ProcessAuthenticateMessage(am *messages.Authenticate)
 	return nil
 }
 
+// Finish an anonymous authentication, the keys are derived from the zero session base key
+func (n *V2ServerSession) processAnonymousAuthenticate(am *messages.Authenticate) (err error) {
+	err = n.acceptAnonymous()
+	if err != nil {
+		return err
+	}
+
+	err = n.computeExportedSessionKey()
+	if err != nil {
+		return err
+	}
+
+	err = n.calculateKeys(am.Version.NtlmRevision())
+	if err != nil {
+		return err
+	}
+
+	return n.initHandles()
+}
+
 func (n *V2ServerSession) computeExportedSessionKey() (err error) {
 	if messages.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags) {
+		if len(n.encryptedRandomSessionKey) != 16 {
+			return newMalformedMessageError("Invalid encrypted random session key")
+		}
 		n.exportedSessionKey, err = rc4K(n.keyExchangeKey, n.encryptedRandomSessionKey)
 		if err != nil {
 			return err
 		}
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.exportedSessionKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	} else {
 		n.exportedSessionKey = n.keyExchangeKey
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.keyExchangeKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	}
 	return nil
 }
@@ -280,17 +389,8 @@ type V2ClientSession struct {
 	V2Session
 }
 
-func (n *V2ClientSession) GenerateNegotiateMessage() (nm *messages.Negotiate, err error) {
-	return nil, nil
-}
-
-func (n *V2ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err error) {
-	n.challengeMessage = cm
-	n.serverChallenge = cm.ServerChallenge
-	n.clientChallenge = randomBytes(8)
-
-	// Set up the default flags for processing the response. These are the flags that we will return
-	// in the authenticate message
+// The flags the client requests in the negotiate message unless SetSupportedFlags is used
+func (n *V2ClientSession) clientFlags() uint32 {
 	flags := uint32(0)
 	flags = messages.NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_VERSION.Set(flags)
@@ -299,45 +399,109 @@ func (n *V2ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 	flags = messages.NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_NTLM.Set(flags)
-	flags = messages.NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_SEAL.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_SIGN.Set(flags)
 	flags = messages.NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = messages.NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = messages.NTLM_NEGOTIATE_OEM.Set(flags)
 	flags = messages.NTLMSSP_NEGOTIATE_128.Set(flags)
 
-	n.NegotiateFlags = flags
+	return n.offeredFlags(flags)
+}
+
+func (n *V2ClientSession) GenerateNegotiateMessage() (nm *messages.Negotiate, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	// The negotiate message may be generated again until a challenge has been processed
+	err = n.checkState(stateInitial, stateNegotiated)
+	if err != nil {
+		return nil, err
+	}
+	err = n.advance(stateNegotiated, n.checkClientVersion(Version2))
+	if err != nil {
+		return nil, err
+	}
+	return n.newNegotiateMessage(n.clientFlags()), nil
+}
+
+func (n *V2ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	// The negotiate message is not sent in connectionless mode
+	err = n.checkState(stateInitial, stateNegotiated)
+	if err != nil {
+		return err
+	}
+	return n.advance(stateChallenged, n.processChallengeMessage(cm))
+}
+
+func (n *V2ClientSession) processChallengeMessage(cm *messages.Challenge) (err error) {
+	err = n.checkClientVersion(Version2)
+	if err != nil {
+		return err
+	}
+
+	n.challengeMessage = cm
+	n.serverChallenge = cm.ServerChallenge
+	n.clientChallenge = randomBytes(8)
+
+	// These are the flags that we will return in the authenticate message, what the server offered and we support
+	n.negotiatedFlags, err = n.negotiateFlags(cm.NegotiateFlags, n.clientFlags())
+	if err != nil {
+		return err
+	}
+	n.NegotiateFlags = n.negotiatedFlags
 
 	err = n.fetchResponseKeys()
 	if err != nil {
 		return err
 	}
 
-	timestamp := timeToWindowsFileTime(time.Now())
-	err = n.computeExpectedResponses(timestamp, cm.TargetInfoPayloadStruct.Payload)
+	// Tell the server that the authenticate message will carry a MIC
+	targetInfo, err := messages.ReadAvPairs(cm.TargetInfoPayloadStruct.Payload)
 	if err != nil {
 		return err
 	}
+	targetInfo.SetFlags(targetInfo.Flags() | messages.MsvAvFlagMICProvided)
+	if n.channelBindings != nil {
+		targetInfo.SetAvPair(messages.MsvChannelBindings, n.channelBindings)
+	}
+	n.addTargetName(targetInfo)
 
-	err = n.computeKeyExchangeKey()
+	// Use the time of the server when it sent one, the LMv2 response is not sent in that case as it has no timestamp
+	timestamp := targetInfo.ByteValue(messages.MsvAvTimestamp)
+	if len(timestamp) != 8 {
+		timestamp = messages.TimeToFileTime(time.Now())
+	}
+	err = n.computeExpectedResponses(timestamp, targetInfo.Bytes())
 	if err != nil {
 		return err
 	}
+	if targetInfo.Find(messages.MsvAvTimestamp) != nil {
+		n.lmChallengeResponse = zeroBytes(24)
+	}
 
-	err = n.computeEncryptedSessionKey()
+	err = n.computeKeyExchangeKey()
 	if err != nil {
 		return err
 	}
 
-	err = n.calculateKeys(cm.Version.NTLMRevisionCurrent)
+	if n.anonymousClient() {
+		n.computeAnonymousResponses()
+	}
+
+	err = n.computeEncryptedSessionKey()
 	if err != nil {
 		return err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	err = n.calculateKeys(cm.Version.NtlmRevision())
 	if err != nil {
 		return err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+
+	err = n.initHandles()
 	if err != nil {
 		return err
 	}
@@ -345,18 +509,29 @@ func (n *V2ClientSession) ProcessChallengeMessage(cm *messages.Challenge) (err e
 }
 
 func (n *V2ClientSession) GenerateAuthenticateMessage() (am *messages.Authenticate, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	err = n.checkState(stateChallenged)
+	if err != nil {
+		return nil, err
+	}
+	n.state = stateAuthenticated
+
 	am = new(messages.Authenticate)
 	am.Signature = []byte("NTLMSSP\x00")
 	am.MessageType = uint32(3)
 	am.LmChallengeResponse, _ = messages.CreateBytePayload(n.lmChallengeResponse)
 	am.NtChallengeResponseFields, _ = messages.CreateBytePayload(n.ntChallengeResponse)
-	am.DomainName, _ = messages.CreateStringPayload(n.userDomain)
-	am.UserName, _ = messages.CreateStringPayload(n.user)
-	am.Workstation, _ = messages.CreateStringPayload("SQUAREMILL")
+	am.DomainName, _ = messages.CreateNegotiatedStringPayload(n.userDomain, n.negotiatedFlags, n.oemCodePage)
+	am.UserName, _ = messages.CreateNegotiatedStringPayload(n.user, n.negotiatedFlags, n.oemCodePage)
+	am.Workstation, _ = messages.CreateNegotiatedStringPayload(n.getClientInfo().Workstation, n.negotiatedFlags, n.oemCodePage)
 	am.EncryptedRandomSessionKey, _ = messages.CreateBytePayload(n.encryptedRandomSessionKey)
-	am.NegotiateFlags = n.NegotiateFlags
-	am.Mic = make([]byte, 16)
-	am.Version = &messages.VersionStruct{ProductMajorVersion: uint8(5), ProductMinorVersion: uint8(1), ProductBuild: uint16(2600), NTLMRevisionCurrent: 0x0F}
+	am.NegotiateFlags = n.negotiatedFlags
+	am.Version = n.getClientInfo().Version
+	// An anonymous client has no key to protect the messages with
+	if !n.anonymousClient() {
+		am.Mic = n.computeMic(am)
+	}
 	return am, nil
 }
 
@@ -368,7 +543,9 @@ func (n *V2ClientSession) computeEncryptedSessionKey() (err error) {
 			return err
 		}
 	} else {
-		n.encryptedRandomSessionKey = n.keyExchangeKey
+		// Without key exchange the key exchange key is used directly and no session key is sent
+		n.exportedSessionKey = n.keyExchangeKey
+		n.encryptedRandomSessionKey = make([]byte, 0)
 	}
 	return nil
 }
@@ -379,23 +556,16 @@ func (n *V2ClientSession) computeEncryptedSessionKey() (err error) {
 
 // Define ntowfv2(Passwd, User, UserDom) as
 func ntowfv2(user string, passwd string, userDom string) []byte {
+	return ntowfv2Hash(user, md4(utf16FromString(passwd)), userDom)
+}
+
+// NTOWFv2 computed from the NT hash of the password, MD4(UNICODE(Passwd))
+func ntowfv2Hash(user string, ntHash []byte, userDom string) []byte {
 	concat := utf16FromString(strings.ToUpper(user) + userDom)
-	return hmacMd5(md4(utf16FromString(passwd)), concat)
+	return hmacMd5(ntHash, concat)
 }
 
 // Define lmowfv2(Passwd, User, UserDom) as
 func lmowfv2(user string, passwd string, userDom string) []byte {
 	return ntowfv2(user, passwd, userDom)
 }
-
-/********************************
- Helper functions
-*********************************/
-
-func timeToWindowsFileTime(t time.Time) []byte {
-	var ll int64
-	ll = (int64(t.Unix()) * int64(10000000)) + int64(116444736000000000)
-	buffer := bytes.NewBuffer(make([]byte, 0, 8))
-	binary.Write(buffer, binary.LittleEndian, ll)
-	return buffer.Bytes()
-}
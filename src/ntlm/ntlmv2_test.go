@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"ntlm/messages"
 	"strings"
 	"testing"
@@ -65,7 +66,7 @@ func TestNTLMv2(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef00000000000000002400240044000000060070170000000f53006500720076006500720002000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
 	challengeMessage, err := messages.ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -77,7 +78,7 @@ func TestNTLMv2(t *testing.T) {
 
 	server := new(V2ServerSession)
 	server.SetUserInfo("User", "Password", "Domain")
-	server.serverChallenge = challengeMessage.ServerChallenge
+	server.SetServerChallenge(challengeMessage.ServerChallenge)
 
 	// Authenticate message
 	r := strings.NewReplacer("\n", "", "\t", "", " ", "")
@@ -98,9 +99,9 @@ func TestNTLMv2(t *testing.T) {
 		0000000000000000c5dad2544fc97990
 		94ce1ce90bc9d03e`))
 
-	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes, 2)
+	authenticateMessage, err := messages.ParseAuthenticateMessage(authenticateMessageBytes)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
@@ -117,9 +118,11 @@ func TestNTLMv2(t *testing.T) {
 	checkV2Value(t, "client seal key", server.ClientSealingKey, "59f600973cc4960a25480a7c196e4c58", nil)
 	checkV2Value(t, "client signing key", server.ClientSigningKey, "4788dc861b4782f35d43fd98fe1a2d39", nil)
 
-	// Have the server generate an initial challenge message
+	// Have a new server generate an initial challenge message, the handshake of the first one is complete
+	server = new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain")
 	challenge, err := server.GenerateChallengeMessage()
-	challenge.String()
+	_ = challenge.String()
 
 	// Have the client process this server challenge message
 	client = new(V2ClientSession)
@@ -165,14 +168,14 @@ func TestNTLMv2WithDomain(t *testing.T) {
 	server.SetUserInfo("blahblah", "Welcome1", "blahblah")
 
 	authenticateData, _ := base64.StdEncoding.DecodeString(authenticateMessage)
-	a, _ := messages.ParseAuthenticateMessage(authenticateData, 2)
+	a, _ := messages.ParseAuthenticateMessage(authenticateData)
 
 	serverChallenge, _ := hex.DecodeString("3d74b2d04ebe1eb3")
 	server.SetServerChallenge(serverChallenge)
 
 	err := server.ProcessAuthenticateMessage(a)
 	if err != nil {
-		t.Error("Could not process authenticate message: %s\n", err)
+		t.Errorf("Could not process authenticate message: %s\n", err)
 	}
 }
 
@@ -184,6 +187,350 @@ func TestWindowsTimeConversion(t *testing.T) {
 	// will give us tenths of a microsecond (127003176000000000). As a little-endian 64-bit value, this is
 	// "0x0090d336b734c301" (in hexadecimal).
 	unix := time.Unix(1055844000, 0)
-	result := timeToWindowsFileTime(unix)
+	result := messages.TimeToFileTime(unix)
 	checkV2Value(t, "Timestamp", result, "0090d336b734c301", nil)
+
+	// The conversion keeps the 100 nanosecond precision of FILETIME
+	precise := time.Unix(1055844000, 123456700)
+	if !messages.FileTimeToTime(messages.TimeToFileTime(precise)).Equal(precise) {
+		t.Errorf("Timestamp %s did not convert back to %s", messages.FileTimeToTime(messages.TimeToFileTime(precise)), precise)
+	}
+}
+
+// Run a complete handshake between a client and a server and return the first error
+func handshakeError(client ClientSession, server ServerSession) error {
+	negotiate, err := client.GenerateNegotiateMessage()
+	if err != nil {
+		return err
+	}
+	err = server.ProcessNegotiateMessage(negotiate)
+	if err != nil {
+		return err
+	}
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		return err
+	}
+	err = client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		return err
+	}
+	authenticate, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		return err
+	}
+	authenticate, err = messages.ParseAuthenticateMessage(authenticate.Bytes())
+	if err != nil {
+		return err
+	}
+	return server.ProcessAuthenticateMessage(authenticate)
+}
+
+// Run a complete handshake between a client and a server, passing the messages through their byte representation
+func runHandshake(t *testing.T, client ClientSession, server ServerSession) {
+	negotiate, err := client.GenerateNegotiateMessage()
+	if err != nil {
+		t.Fatalf("Could not generate negotiate message: %s", err)
+	}
+	negotiate, err = messages.ParseNegotiateMessage(negotiate.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse negotiate message: %s", err)
+	}
+	err = server.ProcessNegotiateMessage(negotiate)
+	if err != nil {
+		t.Fatalf("Could not process negotiate message: %s", err)
+	}
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+	challenge, err = messages.ParseChallengeMessage(challenge.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+	err = client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	authenticate, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		t.Fatalf("Could not generate authenticate message: %s", err)
+	}
+	authenticate, err = messages.ParseAuthenticateMessage(authenticate.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	err = server.ProcessAuthenticateMessage(authenticate)
+	if err != nil {
+		t.Fatalf("Could not process authenticate message: %s", err)
+	}
+}
+
+func TestNTLMv2ConnectionOrientedMac(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	runHandshake(t, client, server)
+
+	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(server.GetSessionData().NegotiateFlags) {
+		t.Error("NTLMSSP_NEGOTIATE_DATAGRAM should not be negotiated in connection oriented mode")
+	}
+
+	// The sequence numbers passed in are ignored, the sessions keep track of them
+	for i := 0; i < 3; i++ {
+		message := []byte("<NTLM><foo><bar>")
+		mac, _ := client.Mac(message, 0)
+		if ok, _ := server.VerifyMac(message, mac, 0); !ok {
+			t.Errorf("Server could not verify client mac %d", i)
+		}
+		mac, _ = server.Mac(message, 0)
+		if ok, _ := client.VerifyMac(message, mac, 0); !ok {
+			t.Errorf("Client could not verify server mac %d", i)
+		}
+	}
+
+	// Replaying a previous signature must fail as the sequence number has moved on
+	message := []byte("<NTLM><foo><bar>")
+	mac, _ := client.Mac(message, 0)
+	server.VerifyMac(message, mac, 0)
+	if ok, _ := server.VerifyMac(message, mac, 0); ok {
+		t.Error("Server verified a replayed client mac")
+	}
+}
+
+func TestNTLMv2ConnectionlessMac(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionlessMode)
+	runHandshake(t, client, server)
+
+	message := []byte("<NTLM><foo><bar>")
+	mac, _ := client.Mac(message, 100)
+	if ok, _ := server.VerifyMac(message, mac, 100); !ok {
+		t.Error("Server could not verify client mac")
+	}
+	mac, _ = server.Mac(message, 5)
+	if ok, _ := client.VerifyMac(message, mac, 5); !ok {
+		t.Error("Client could not verify server mac")
+	}
+	if ok, _ := client.VerifyMac(message, mac, 6); ok {
+		t.Error("Client verified a mac with the wrong sequence number")
+	}
+}
+
+// Run a handshake where the flags of the authenticate message are modified in transit, returns the servers result
+func runTamperedHandshake(t *testing.T, client ClientSession, server ServerSession) error {
+	negotiate, _ := client.GenerateNegotiateMessage()
+	negotiate, _ = messages.ParseNegotiateMessage(negotiate.Bytes())
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	challenge, _ = messages.ParseChallengeMessage(challenge.Bytes())
+	err := client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticateBytes := authenticate.Bytes()
+
+	// Strip NTLMSSP_NEGOTIATE_SIGN from the negotiate flags
+	authenticateBytes[60] = authenticateBytes[60] &^ 0x10
+
+	authenticate, err = messages.ParseAuthenticateMessage(authenticateBytes)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	return server.ProcessAuthenticateMessage(authenticate)
+}
+
+func TestNTLMv2Mic(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	runHandshake(t, client, server)
+
+	data := server.GetSessionData()
+	if data.authenticateMessage.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.Flags()&messages.MsvAvFlagMICProvided == 0 {
+		t.Error("Client did not set the MIC bit in MsvAvFlags")
+	}
+	if bytes.Equal(data.mic, zeroBytes(16)) {
+		t.Error("Client did not provide a MIC")
+	}
+
+	client, server = newTestSessions(t, Version2, ConnectionOrientedMode)
+	if runTamperedHandshake(t, client, server) == nil {
+		t.Error("Server accepted an authenticate message with modified flags")
+	}
+}
+
+func TestNTLMv2MicWithoutChallenge(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	client.ProcessChallengeMessage(challenge)
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticate, _ = messages.ParseAuthenticateMessage(authenticate.Bytes())
+
+	// A server that only knows the server challenge can not verify the MIC
+	server = newTestServer(t, Version2, ConnectionOrientedMode)
+	server.SetServerChallenge(challenge.ServerChallenge)
+	err := server.ProcessAuthenticateMessage(authenticate)
+	if err != ErrMicWithoutChallenge || !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrMicWithoutChallenge but got %v", err)
+	}
+}
+
+func TestNTLMv2FlagNegotiation(t *testing.T) {
+	// Both sides support sealing and 128 bit keys by default
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	server.SetRequiredFlags(uint32(messages.NTLMSSP_NEGOTIATE_128 | messages.NTLMSSP_NEGOTIATE_SEAL))
+	client.SetRequiredFlags(uint32(messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY | messages.NTLMSSP_NEGOTIATE_SIGN))
+	runHandshake(t, client, server)
+
+	// A client that does not support sealing can not talk to a server that requires it
+	server, _ = CreateServerSession(Version2, ConnectionOrientedMode)
+	server.SetRequiredFlags(uint32(messages.NTLMSSP_NEGOTIATE_SEAL))
+	client, _ = CreateClientSession(Version2, ConnectionOrientedMode)
+	client.SetSupportedFlags(client.(*V2ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_SEAL))
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	_, err := server.GenerateChallengeMessage()
+	if err == nil {
+		t.Error("Server generated a challenge message without the required NTLMSSP_NEGOTIATE_SEAL flag")
+	}
+
+	// The client checks the flags offered by the server in the challenge message
+	server, _ = CreateServerSession(Version2, ConnectionlessMode)
+	server.SetSupportedFlags(server.(*V2ServerSession).serverFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_128))
+	client = newTestClient(t, Version2, ConnectionlessMode)
+	client.SetRequiredFlags(uint32(messages.NTLMSSP_NEGOTIATE_128))
+	challenge, _ := server.GenerateChallengeMessage()
+	if messages.NTLMSSP_NEGOTIATE_128.IsSet(challenge.NegotiateFlags) {
+		t.Error("Server offered NTLMSSP_NEGOTIATE_128 which it does not support")
+	}
+	err = client.ProcessChallengeMessage(challenge)
+	if err == nil {
+		t.Error("Client accepted a challenge message without the required NTLMSSP_NEGOTIATE_128 flag")
+	}
+}
+
+func TestAuthenticateFlagsNotOffered(t *testing.T) {
+	// A connection oriented server does not offer NTLMSSP_NEGOTIATE_DATAGRAM
+	addDatagram := func(authenticate []byte) {
+		authenticate[60] |= 0x40
+	}
+
+	for _, version := range []Version{Version1, Version2} {
+		client, server := newTestSessions(t, version, ConnectionOrientedMode)
+		err := tamperedHandshakeError(client, server, addDatagram)
+		if !errors.Is(err, ErrAuthenticationFailed) || !strings.Contains(err.Error(), "NTLMSSP_NEGOTIATE_DATAGRAM") {
+			t.Errorf("NTLMv%d: Expected the flag that was not offered to be refused but got %v", version, err)
+		}
+	}
+}
+
+func TestNTLMv2WithoutKeyExchange(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	client.SetSupportedFlags(client.(*V2ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_NEGOTIATE_KEY_EXCH))
+	runHandshake(t, client, server)
+
+	data := server.GetSessionData()
+	if messages.NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(data.NegotiateFlags) {
+		t.Error("NTLMSSP_NEGOTIATE_KEY_EXCH was negotiated although the client does not support it")
+	}
+	if len(data.authenticateMessage.EncryptedRandomSessionKey.Payload) != 0 {
+		t.Error("Client sent a session key without key exchange")
+	}
+	checkSealUnseal(t, client, server, 0)
+}
+
+func TestNTLMv2ClockSkew(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	server.SetMaxClockSkew(5 * time.Minute)
+	runHandshake(t, client, server)
+
+	// The client uses the timestamp of the server and sends no LMv2 response
+	data := server.GetSessionData()
+	if !bytes.Equal(data.authenticateMessage.NtlmV2Response.NtlmV2ClientChallenge.TimeStamp, data.challengeMessage.TargetInfo.ByteValue(messages.MsvAvTimestamp)) {
+		t.Error("Client did not use the timestamp from the challenge message")
+	}
+	checkV2Value(t, "LMChallengeResponse", data.authenticateMessage.LmChallengeResponse.Payload, hex.EncodeToString(zeroBytes(24)), nil)
+
+	// A response with an old timestamp is rejected
+	client, server = newTestSessions(t, Version2, ConnectionOrientedMode)
+	server.SetMaxClockSkew(5 * time.Minute)
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	challenge.TargetInfo.SetTimestamp(time.Now().Add(-time.Hour))
+	challenge.TargetInfoPayloadStruct, _ = messages.CreateBytePayload(challenge.TargetInfo.Bytes())
+	client.ProcessChallengeMessage(challenge)
+	authenticate, _ := client.GenerateAuthenticateMessage()
+	authenticate, _ = messages.ParseAuthenticateMessage(authenticate.Bytes())
+	err := server.ProcessAuthenticateMessage(authenticate)
+	if err != ErrStaleResponse {
+		t.Errorf("Expected ErrStaleResponse for an old timestamp but got %v", err)
+	}
+}
+
+func TestOemStrings(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		client, _ := CreateClientSession(version, ConnectionOrientedMode)
+		client.SetUserInfo("Jürgen", "Password", "Domäne")
+		client.SetClientInfo(ClientInfo{Workstation: "WS01"})
+		// An old client that only knows the OEM character set
+		flags := client.(interface{ clientFlags() uint32 }).clientFlags()
+		client.SetSupportedFlags(messages.NTLMSSP_NEGOTIATE_UNICODE.Unset(flags))
+
+		server, _ := CreateServerSession(VersionAuto, ConnectionOrientedMode)
+		server.SetUserInfo("Jürgen", "Password", "Domäne")
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		server.SetServerInfo(ServerInfo{NetbiosComputerName: "SERVER", NetbiosDomainName: "DOMÄNE"})
+		runHandshake(t, client, server)
+
+		data := server.GetSessionData()
+		if !messages.IsOemNegotiated(data.authenticateMessage.NegotiateFlags) {
+			t.Fatalf("NTLMv%d: the OEM character set was not negotiated", version)
+		}
+		if data.authenticateMessage.UserName.Type != messages.OemStringPayload || data.authenticateMessage.UserName.Len != 6 {
+			t.Errorf("NTLMv%d: the user name was not sent as an OEM string", version)
+		}
+		user, _, domain := server.GetUserInfo()
+		if user != "Jürgen" || domain != "Domäne" || data.authenticateMessage.Workstation.String() != "WS01" {
+			t.Errorf("NTLMv%d: got user %s domain %s workstation %s", version, user, domain, data.authenticateMessage.Workstation.String())
+		}
+
+		challenge, _ := messages.ParseChallengeMessage(data.challengeMessage.Bytes())
+		if challenge.TargetName.Type != messages.OemStringPayload || challenge.TargetName.String() != "SERVER" {
+			t.Errorf("NTLMv%d: the target name was not sent as an OEM string", version)
+		}
+		checkSealUnseal(t, client, server, 0)
+	}
+}
+
+func TestOemCodePage(t *testing.T) {
+	newOemSessions := func(version Version, clientCodePage, serverCodePage *messages.CodePage) (ClientSession, ServerSession) {
+		client, _ := CreateClientSession(version, ConnectionOrientedMode)
+		client.SetUserInfo("Søren", "Password", "Domain")
+		client.SetOemCodePage(clientCodePage)
+		flags := client.(interface{ clientFlags() uint32 }).clientFlags()
+		client.SetSupportedFlags(messages.NTLMSSP_NEGOTIATE_UNICODE.Unset(flags))
+
+		server, _ := CreateServerSession(VersionAuto, ConnectionOrientedMode)
+		server.SetLmCompatibilityLevel(LmCompatibilityLevel3)
+		server.SetUserInfo("Søren", "Password", "Domain")
+		server.SetOemCodePage(serverCodePage)
+		return client, server
+	}
+
+	for _, version := range []Version{Version1, Version2} {
+		client, server := newOemSessions(version, messages.CodePage850, messages.CodePage850)
+		runHandshake(t, client, server)
+		if user, _, _ := server.GetUserInfo(); user != "Søren" {
+			t.Errorf("NTLMv%d: Expected the user Søren with code page 850 but got %s", version, user)
+		}
+
+		// A server that reads the name in another code page gets another user, NTLMv2 responses cover the user name
+		client, server = newOemSessions(version, messages.CodePage850, nil)
+		if err := handshakeError(client, server); version == Version2 && err == nil {
+			t.Errorf("NTLMv%d: Expected the handshake to fail when the code pages differ", version)
+		}
+		if user, _, _ := server.GetUserInfo(); user != "S¢ren" {
+			t.Errorf("NTLMv%d: Expected code page 437 to read the user as S¢ren but got %s", version, user)
+		}
+	}
 }
@@ -0,0 +1,124 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"os"
+	"strings"
+)
+
+type TargetType int
+
+const (
+	// The TargetName of the challenge message is the NetBIOS computer name of the server
+	TargetTypeServer TargetType = iota
+	// The TargetName of the challenge message is the NetBIOS domain name of the server
+	TargetTypeDomain
+)
+
+// The identity a server advertises in the TargetName and TargetInfo fields of the CHALLENGE_MESSAGE
+type ServerInfo struct {
+	NetbiosDomainName   string
+	NetbiosComputerName string
+	DnsDomainName       string
+	DnsComputerName     string
+	DnsTreeName         string
+
+	TargetType TargetType
+
+	// The version advertised in the challenge message when NTLMSSP_NEGOTIATE_VERSION is negotiated
+	Version *messages.VersionStruct
+}
+
+// The server info used when SetServerInfo is not called, the names are taken from the hostname of the machine
+func DefaultServerInfo() *ServerInfo {
+	info := new(ServerInfo)
+	hostname, _ := os.Hostname()
+	info.DnsComputerName = hostname
+	if i := strings.Index(hostname, "."); i >= 0 {
+		info.DnsDomainName = hostname[i+1:]
+	}
+	info.NetbiosComputerName = netbiosName(hostname)
+	// A server that is not part of a domain uses its computer name as the domain name
+	info.NetbiosDomainName = info.NetbiosComputerName
+	info.TargetType = TargetTypeServer
+	info.Version = defaultVersion()
+	return info
+}
+
+// Set the identity the server advertises in the challenge message, missing NetBIOS names and version are taken
+// from DefaultServerInfo
+func (n *SessionData) SetServerInfo(info ServerInfo) {
+	defaults := DefaultServerInfo()
+	if info.NetbiosComputerName == "" {
+		info.NetbiosComputerName = defaults.NetbiosComputerName
+	}
+	if info.NetbiosDomainName == "" {
+		info.NetbiosDomainName = info.NetbiosComputerName
+	}
+	if info.Version == nil {
+		info.Version = defaults.Version
+	}
+	n.serverInfo = &info
+}
+
+// The server info of the session, DefaultServerInfo when none was set
+func (n *SessionData) getServerInfo() *ServerInfo {
+	if n.serverInfo == nil {
+		n.serverInfo = DefaultServerInfo()
+	}
+	return n.serverInfo
+}
+
+// The TargetName of the challenge message depends on the target type, the flags are updated to match
+func (info *ServerInfo) targetName(flags uint32) (string, uint32) {
+	flags = messages.NTLMSSP_TARGET_TYPE_DOMAIN.Unset(flags)
+	flags = messages.NTLMSSP_TARGET_TYPE_SERVER.Unset(flags)
+	if !messages.NTLMSSP_REQUEST_TARGET.IsSet(flags) {
+		return "", flags
+	}
+	if info.TargetType == TargetTypeDomain {
+		return info.NetbiosDomainName, messages.NTLMSSP_TARGET_TYPE_DOMAIN.Set(flags)
+	}
+	return info.NetbiosComputerName, messages.NTLMSSP_TARGET_TYPE_SERVER.Set(flags)
+}
+
+// The AvPairs sent in the TargetInfo field of the challenge message, the NetBIOS names must always be present
+func (info *ServerInfo) targetInfo() *messages.AvPairs {
+	pairs := new(messages.AvPairs)
+	pairs.AddAvPair(messages.MsvAvNbDomainName, messages.StringToUtf16(info.NetbiosDomainName))
+	pairs.AddAvPair(messages.MsvAvNbComputerName, messages.StringToUtf16(info.NetbiosComputerName))
+	if info.DnsDomainName != "" {
+		pairs.AddAvPair(messages.MsvAvDnsDomainName, messages.StringToUtf16(info.DnsDomainName))
+	}
+	if info.DnsComputerName != "" {
+		pairs.AddAvPair(messages.MsvAvDnsComputerName, messages.StringToUtf16(info.DnsComputerName))
+	}
+	if info.DnsTreeName != "" {
+		pairs.AddAvPair(messages.MsvAvDnsTreeName, messages.StringToUtf16(info.DnsTreeName))
+	}
+	pairs.AddAvPair(messages.MsvAvEOL, make([]byte, 0))
+	return pairs
+}
+
+// The NetBIOS name for a hostname, at most 15 characters of the first label in upper case
+func netbiosName(hostname string) string {
+	if i := strings.Index(hostname, "."); i >= 0 {
+		hostname = hostname[:i]
+	}
+	if len(hostname) > 15 {
+		hostname = hostname[:15]
+	}
+	return strings.ToUpper(hostname)
+}
+
+// The version sent in NTLM messages unless configured otherwise, Windows 10 / Server 2022 (10.0.20348)
+func defaultVersion() *messages.VersionStruct {
+	return &messages.VersionStruct{ProductMajorVersion: uint8(10), ProductMinorVersion: uint8(0), ProductBuild: uint16(20348), NTLMRevisionCurrent: uint8(15)}
+}
+
+// The Windows XP version (5.1.2600) this package sent by default in the past, it can be passed to SetServerInfo or
+// SetClientInfo for peers that expect it
+func WindowsXPVersion() *messages.VersionStruct {
+	return &messages.VersionStruct{ProductMajorVersion: uint8(5), ProductMinorVersion: uint8(1), ProductBuild: uint16(2600), NTLMRevisionCurrent: uint8(15)}
+}
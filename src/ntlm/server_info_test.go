@@ -0,0 +1,81 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+)
+
+func TestServerInfoInChallenge(t *testing.T) {
+	server, _ := CreateServerSession(Version2, ConnectionOrientedMode)
+	server.SetServerInfo(ServerInfo{
+		NetbiosDomainName:   "EXAMPLE",
+		NetbiosComputerName: "WEB01",
+		DnsDomainName:       "example.com",
+		DnsComputerName:     "web01.example.com",
+		DnsTreeName:         "example.com",
+		TargetType:          TargetTypeDomain,
+		Version:             &messages.VersionStruct{ProductMajorVersion: 6, ProductMinorVersion: 1, ProductBuild: 7601, NTLMRevisionCurrent: 15}})
+	client, _ := CreateClientSession(Version2, ConnectionOrientedMode)
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+	challenge, err := messages.ParseChallengeMessage(challenge.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+
+	if challenge.TargetName.String() != "EXAMPLE" {
+		t.Errorf("TargetName should be the NetBIOS domain name but was %s", challenge.TargetName.String())
+	}
+	if !messages.NTLMSSP_TARGET_TYPE_DOMAIN.IsSet(challenge.NegotiateFlags) || messages.NTLMSSP_TARGET_TYPE_SERVER.IsSet(challenge.NegotiateFlags) {
+		t.Error("Only NTLMSSP_TARGET_TYPE_DOMAIN should be set")
+	}
+	expected := map[messages.AvPairType]string{
+		messages.MsvAvNbDomainName:    "EXAMPLE",
+		messages.MsvAvNbComputerName:  "WEB01",
+		messages.MsvAvDnsDomainName:   "example.com",
+		messages.MsvAvDnsComputerName: "web01.example.com",
+		messages.MsvAvDnsTreeName:     "example.com"}
+	for avId, value := range expected {
+		if challenge.TargetInfo.StringValue(avId) != value {
+			t.Errorf("AvPair %d should be %s but was %s", avId, value, challenge.TargetInfo.StringValue(avId))
+		}
+	}
+	if challenge.Version.ProductBuild != 7601 {
+		t.Errorf("Version build should be 7601 but was %d", challenge.Version.ProductBuild)
+	}
+}
+
+func TestServerInfoWithoutRequestTarget(t *testing.T) {
+	server, _ := CreateServerSession(Version2, ConnectionOrientedMode)
+	server.SetServerInfo(ServerInfo{NetbiosComputerName: "WEB01"})
+	client, _ := CreateClientSession(Version2, ConnectionOrientedMode)
+	client.SetSupportedFlags(client.(*V2ClientSession).clientFlags() &^ uint32(messages.NTLMSSP_REQUEST_TARGET))
+	negotiate, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ := server.GenerateChallengeMessage()
+
+	if challenge.TargetName.Len != 0 {
+		t.Errorf("TargetName should be empty when it was not requested but was %s", challenge.TargetName.String())
+	}
+	if messages.NTLMSSP_TARGET_TYPE_SERVER.IsSet(challenge.NegotiateFlags) || messages.NTLMSSP_REQUEST_TARGET.IsSet(challenge.NegotiateFlags) {
+		t.Error("Target flags should not be set when the target was not requested")
+	}
+	// The NetBIOS domain name defaults to the computer name
+	if challenge.TargetInfo.StringValue(messages.MsvAvNbDomainName) != "WEB01" {
+		t.Errorf("NetBIOS domain name should default to the computer name but was %s", challenge.TargetInfo.StringValue(messages.MsvAvNbDomainName))
+	}
+	if challenge.Version.ProductMajorVersion != 10 || challenge.Version.ProductBuild != 20348 {
+		t.Errorf("Version should default to 10.0.20348 but was %s", challenge.Version.String())
+	}
+
+	// The legacy Windows XP version can still be advertised
+	server, _ = CreateServerSession(Version2, ConnectionOrientedMode)
+	server.SetServerInfo(ServerInfo{NetbiosComputerName: "WEB01", Version: WindowsXPVersion()})
+	server.ProcessNegotiateMessage(negotiate)
+	challenge, _ = server.GenerateChallengeMessage()
+	if challenge.Version.ProductMajorVersion != 5 || challenge.Version.ProductBuild != 2600 {
+		t.Errorf("Version should be 5.1.2600 but was %s", challenge.Version.String())
+	}
+}
@@ -0,0 +1,136 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"errors"
+	"ntlm/messages"
+)
+
+var (
+	// Returned when a method is called at the wrong point of the handshake, for example GenerateAuthenticateMessage
+	// before ProcessChallengeMessage or Seal before the session keys are known
+	ErrInvalidState = errors.New("Operation is not allowed in the current state of the session")
+	// Returned by a server that could not authenticate the client. The errors for the specific reasons, such as
+	// ErrStaleResponse or ErrChannelBindings, also match it with errors.Is.
+	ErrAuthenticationFailed = errors.New("Could not authenticate")
+	// Returned when a message is malformed or lacks a required part, the parse errors of package messages also match
+	// it with errors.Is
+	ErrMalformedMessage = messages.ErrMalformedMessage
+)
+
+// An error that is one reason for authentication to fail, errors.Is matches it with ErrAuthenticationFailed
+type authenticationError struct {
+	message string
+}
+
+func newAuthenticationError(message string) error {
+	return &authenticationError{message: message}
+}
+
+func (e *authenticationError) Error() string {
+	return e.message
+}
+
+func (e *authenticationError) Is(target error) bool {
+	return target == ErrAuthenticationFailed
+}
+
+// An error for a message that parsed but can not be used, errors.Is matches it with ErrMalformedMessage
+type malformedMessageError struct {
+	message string
+}
+
+func newMalformedMessageError(message string) error {
+	return &malformedMessageError{message: message}
+}
+
+func (e *malformedMessageError) Error() string {
+	return e.message
+}
+
+func (e *malformedMessageError) Is(target error) bool {
+	return target == ErrMalformedMessage
+}
+
+// The steps of the handshake a session has completed
+type sessionState int
+
+const (
+	// Nothing has been sent or received
+	stateInitial sessionState = iota
+	// The client has sent the negotiate message or the server has received it
+	stateNegotiated
+	// The server has sent the challenge message or the client has processed it, a client knows the session keys from here
+	stateChallenged
+	// The client has sent the authenticate message or the server has accepted it
+	stateAuthenticated
+	// A step of the handshake failed, the session can not be used any more
+	stateFailed
+)
+
+// Return ErrInvalidState unless the session is in one of the states
+func (n *SessionData) checkState(states ...sessionState) error {
+	for _, state := range states {
+		if n.state == state {
+			return nil
+		}
+	}
+	return ErrInvalidState
+}
+
+// Move to the state reached by a step of the handshake, or to stateFailed when the step returned an error. The error
+// is returned.
+func (n *SessionData) advance(state sessionState, err error) error {
+	if err != nil {
+		n.state = stateFailed
+		return err
+	}
+	n.state = state
+	return nil
+}
+
+// Messages can only be signed and sealed once the keys are known and the handshake has not failed
+func (n *SessionData) checkKeys() error {
+	if n.clientHandle == nil || n.serverHandle == nil || n.state == stateFailed {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+func (n *SessionData) processNegotiateMessage(nm *messages.Negotiate) error {
+	err := n.checkState(stateInitial)
+	if err != nil {
+		return err
+	}
+	n.negotiateMessage = nm
+	n.state = stateNegotiated
+	n.logNegotiateReceived(nm)
+	return nil
+}
+
+// Negotiate the flags and build the challenge message, a new challenge may be generated to replace one that was sent
+func (n *SessionData) generateChallengeMessage(offered uint32) (*messages.Challenge, error) {
+	err := n.checkState(stateInitial, stateNegotiated, stateChallenged)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := n.negotiateServerFlags(offered)
+	if err != nil {
+		n.state = stateFailed
+		return nil, err
+	}
+	cm := n.newChallengeMessage(flags)
+	n.state = stateChallenged
+	n.logChallengeIssued(cm)
+	return cm, nil
+}
+
+// A challenge set by the application has been sent to the client by other means, the server can then process the
+// authenticate message without generating a challenge message. Clients that send a MIC are then refused with
+// ErrMicWithoutChallenge, as the MIC covers the challenge message.
+func (n *SessionData) setServerChallenge(challenge []byte) {
+	n.serverChallenge = challenge
+	if n.state == stateInitial || n.state == stateNegotiated {
+		n.state = stateChallenged
+	}
+}
@@ -0,0 +1,160 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"encoding/binary"
+	"errors"
+	"ntlm/messages"
+	"sync"
+	"testing"
+)
+
+func TestSessionStateClient(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		client, server := newTestSessions(t, version, ConnectionOrientedMode)
+
+		if _, err := client.GenerateAuthenticateMessage(); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for an authenticate message before the challenge but got %v", version, err)
+		}
+		if _, err := client.Mac([]byte("message"), 0); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for Mac before the keys are known but got %v", version, err)
+		}
+		if _, _, err := client.Seal([]byte("message"), 0); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for Seal before the keys are known but got %v", version, err)
+		}
+		if _, err := client.Sign([]byte("message"), 0); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for Sign before the keys are known but got %v", version, err)
+		}
+
+		runHandshake(t, client, server)
+
+		if _, err := client.GenerateNegotiateMessage(); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for a negotiate message after the handshake but got %v", version, err)
+		}
+		if _, err := client.GenerateAuthenticateMessage(); err != ErrInvalidState {
+			t.Errorf("NTLMv%d: Expected ErrInvalidState for a second authenticate message but got %v", version, err)
+		}
+	}
+}
+
+func TestSessionStateServer(t *testing.T) {
+	for _, version := range []Version{Version1, Version2, VersionAuto} {
+		clientVersion := version
+		if version == VersionAuto {
+			clientVersion = Version2
+		}
+		client := newTestClient(t, clientVersion, ConnectionOrientedMode)
+		server := newTestServer(t, version, ConnectionOrientedMode)
+		server.SetUserInfo("User", "Wrong password", "Domain")
+
+		negotiate, _ := client.GenerateNegotiateMessage()
+		am := new(messages.Authenticate)
+		if err := server.ProcessAuthenticateMessage(am); err != ErrInvalidState {
+			t.Errorf("Version %d: Expected ErrInvalidState for an authenticate message before the challenge but got %v", version, err)
+		}
+		if _, _, err := server.Seal([]byte("message"), 0); err != ErrInvalidState {
+			t.Errorf("Version %d: Expected ErrInvalidState for Seal before the keys are known but got %v", version, err)
+		}
+
+		server.ProcessNegotiateMessage(negotiate)
+		if err := server.ProcessNegotiateMessage(negotiate); err != ErrInvalidState {
+			t.Errorf("Version %d: Expected ErrInvalidState for a second negotiate message but got %v", version, err)
+		}
+
+		// A failed authentication ends the session
+		challenge, _ := server.GenerateChallengeMessage()
+		client.ProcessChallengeMessage(challenge)
+		am, _ = client.GenerateAuthenticateMessage()
+		am, _ = messages.ParseAuthenticateMessage(am.Bytes())
+		err := server.ProcessAuthenticateMessage(am)
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Version %d: Expected ErrAuthenticationFailed for the wrong password but got %v", version, err)
+		}
+		if _, err := server.GenerateChallengeMessage(); err != ErrInvalidState {
+			t.Errorf("Version %d: Expected ErrInvalidState for a challenge after a failed authentication but got %v", version, err)
+		}
+		if _, err := server.Mac([]byte("message"), 0); err != ErrInvalidState {
+			t.Errorf("Version %d: Expected ErrInvalidState for Mac after a failed authentication but got %v", version, err)
+		}
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	for _, err := range []error{ErrStaleResponse, ErrChallengeUnknown, ErrChallengeExpired, ErrResponseReplayed, ErrChannelBindings, ErrTargetName, ErrAnonymousNotAllowed, ErrLmCompatibilityLevel, ErrInvalidMic, ErrMicWithoutChallenge} {
+		if !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("%s should match ErrAuthenticationFailed", err)
+		}
+		if errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrInvalidState) {
+			t.Errorf("%s should only match ErrAuthenticationFailed", err)
+		}
+	}
+
+	_, err := messages.ParseAuthenticateMessage([]byte("NTLMSSP\x00\x03\x00\x00\x00"))
+	if !errors.Is(err, ErrMalformedMessage) || !errors.Is(err, messages.ErrTruncated) {
+		t.Errorf("Expected a truncated authenticate message to match ErrMalformedMessage but got %v", err)
+	}
+
+	// An NTLMv2 server needs an NTLMv2 response
+	err = handshakeError(newTestClient(t, Version1, ConnectionOrientedMode), newTestServer(t, Version2, ConnectionOrientedMode))
+	if !errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Expected ErrMalformedMessage for an NTLMv1 response to an NTLMv2 server but got %v", err)
+	}
+}
+
+func TestConcurrentSigning(t *testing.T) {
+	const goroutines = 8
+	const messagesPerGoroutine = 50
+
+	// In connection oriented mode every signature gets its own sequence number
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	runHandshake(t, client, server)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[uint32]bool)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messagesPerGoroutine; j++ {
+				mac, err := client.Mac([]byte("message"), 0)
+				if err != nil {
+					t.Errorf("Could not create mac: %s", err)
+					return
+				}
+				mutex.Lock()
+				seen[binary.LittleEndian.Uint32(mac[12:16])] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != goroutines*messagesPerGoroutine {
+		t.Errorf("Expected %d distinct sequence numbers but got %d", goroutines*messagesPerGoroutine, len(seen))
+	}
+
+	// In connectionless mode the messages can be sealed and unsealed in any order
+	client, server = newTestSessions(t, Version2, ConnectionlessMode)
+	runHandshake(t, client, server)
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messagesPerGoroutine; j++ {
+				sequenceNumber := i*messagesPerGoroutine + j
+				sealed, signature, err := client.Seal([]byte("message"), sequenceNumber)
+				if err != nil {
+					t.Errorf("Could not seal message: %s", err)
+					return
+				}
+				message, ok, err := server.Unseal(sealed, signature, sequenceNumber)
+				if err != nil || !ok || string(message) != "message" {
+					t.Errorf("Could not unseal message %d: %v", sequenceNumber, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -28,10 +28,8 @@ func (n *NtlmsspMessageSignature) String() string {
 func (n *NtlmsspMessageSignature) Bytes() []byte {
 	if n.ByteData != nil {
 		return n.ByteData
-	} else {
-		return concat(n.Version, n.RandomPad, n.CheckSum, n.SeqNum)
 	}
-	return nil
+	return concat(n.Version, n.RandomPad, n.CheckSum, n.SeqNum)
 }
 
 // Define SEAL(Handle, SigningKey, SeqNum, Message) as
@@ -111,6 +109,19 @@ func macWithExtendedSessionSecurity(negFlags uint32, handle *rc4P.Cipher, signin
 	return sig
 }
 
+// In connectionless mode the RC4 handle is reinitialized for every message, in connection oriented mode the
+// handle for the direction is used as is and its state carries over from one message to the next
+func messageHandle(negFlags uint32, handle *rc4P.Cipher, sealingKey []byte, sequenceNumber int) *rc4P.Cipher {
+	if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(negFlags) && messages.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(negFlags) {
+		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
+	} else if messages.NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(negFlags) {
+		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
+		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
+		handle, _ = rc4Init(sealingKey)
+	}
+	return handle
+}
+
 func reinitSealingKey(key []byte, sequenceNumber int) (handle *rc4P.Cipher, err error) {
 	seqNumBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(seqNumBytes, uint32(sequenceNumber))
@@ -64,3 +64,53 @@ func TestSealSignWithExtendedSessionSecurityKeyEx(t *testing.T) {
 	checkSigValue(t, "RC4 CheckSum", sig.CheckSum, "7fb38ec5c55d4976", nil)
 	checkSigValue(t, "Signature", sig.Bytes(), "010000007fb38ec5c55d497600000000", nil)
 }
+
+func checkSealUnseal(t *testing.T, client ClientSession, server ServerSession, sequenceNumber int) {
+	plaintext := []byte("Plaintext message to seal")
+
+	sealed, signature, err := client.Seal(plaintext, sequenceNumber)
+	if err != nil || bytes.Equal(sealed, plaintext) {
+		t.Fatalf("Client could not seal message: %v", err)
+	}
+	unsealed, ok, err := server.Unseal(sealed, signature, sequenceNumber)
+	if err != nil || !ok || !bytes.Equal(unsealed, plaintext) {
+		t.Errorf("Server could not unseal client message got %q verified %v", unsealed, ok)
+	}
+
+	sealed, signature, _ = server.Seal(plaintext, sequenceNumber)
+	unsealed, ok, err = client.Unseal(sealed, signature, sequenceNumber)
+	if err != nil || !ok || !bytes.Equal(unsealed, plaintext) {
+		t.Errorf("Client could not unseal server message got %q verified %v", unsealed, ok)
+	}
+
+	// A tampered message must not verify
+	sealed, signature, _ = client.Seal(plaintext, sequenceNumber+1)
+	sealed[0] = sealed[0] ^ 0xff
+	_, ok, _ = server.Unseal(sealed, signature, sequenceNumber+1)
+	if ok {
+		t.Error("Server verified a tampered sealed message")
+	}
+}
+
+func TestSessionSealConnectionless(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionlessMode)
+	runHandshake(t, client, server)
+
+	checkSealUnseal(t, client, server, 7)
+}
+
+func TestSessionSealConnectionOriented(t *testing.T) {
+	client, server := newTestSessions(t, Version2, ConnectionOrientedMode)
+	runHandshake(t, client, server)
+
+	for i := 0; i < 3; i++ {
+		checkSealUnseal(t, client, server, 0)
+	}
+
+	// Signed messages share the sequence numbers with sealed ones
+	signed, _ := client.Sign([]byte("message"), 0)
+	message := signed[:len(signed)-16]
+	if ok, _ := server.VerifyMac(message, signed[len(signed)-16:], 0); !ok {
+		t.Error("Server could not verify signed client message")
+	}
+}
@@ -0,0 +1,63 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"strings"
+)
+
+// Returned when the target name (SPN) sent by the client is not one of the names the server accepts
+var ErrTargetName = newAuthenticationError("Target name is not accepted by the server")
+
+// Set the service principal name of the server the client authenticates to, for example HTTP/host.example.com. It is
+// sent in the MsvAvTargetName of the NTLMv2 response, untrustedSource should be true when the name was derived from
+// an untrusted source such as an unverified DNS lookup.
+func (n *SessionData) SetTargetName(spn string, untrustedSource bool) {
+	n.targetName = spn
+	n.targetNameUntrusted = untrustedSource
+}
+
+// Set the service principal names the server accepts in the MsvAvTargetName of the client, names are compared case
+// insensitively. A client that sends another name is rejected. When required is true clients that send no name, or a
+// name from an untrusted source, are rejected as well. An empty list disables the check.
+func (n *SessionData) SetAcceptedTargetNames(spns []string, required bool) {
+	n.acceptedTargetNames = spns
+	n.targetNameRequired = required
+}
+
+// Add the target name to the AvPairs a client sends in its NTLMv2 response
+func (n *SessionData) addTargetName(pairs *messages.AvPairs) {
+	if n.targetName == "" {
+		return
+	}
+	pairs.SetAvPair(messages.MsvAvTargetName, messages.StringToUtf16(n.targetName))
+	if n.targetNameUntrusted {
+		pairs.SetFlags(pairs.Flags() | messages.MsvAvFlagUntrustedSPNSource)
+	}
+}
+
+// Check the target name sent by the client, pairs is nil for NTLMv1 responses. A name from an untrusted source can not
+// be relied upon and is treated as if no name was sent.
+func (n *SessionData) verifyTargetName(pairs *messages.AvPairs) error {
+	if len(n.acceptedTargetNames) == 0 {
+		return nil
+	}
+
+	var spn string
+	if pairs != nil && pairs.Flags()&messages.MsvAvFlagUntrustedSPNSource == 0 {
+		spn = pairs.StringValue(messages.MsvAvTargetName)
+	}
+	if spn == "" {
+		if n.targetNameRequired {
+			return ErrTargetName
+		}
+		return nil
+	}
+
+	for _, accepted := range n.acceptedTargetNames {
+		if strings.EqualFold(spn, accepted) {
+			return nil
+		}
+	}
+	return ErrTargetName
+}
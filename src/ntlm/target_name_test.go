@@ -0,0 +1,48 @@
+//Copyright 2013 Thomson Reuters Global Resources.  All Rights Reserved.  Proprietary and confidential information of TRGR.  Disclosure, use, or reproduction without written authorization of TRGR is prohibited.
+package ntlm
+
+import (
+	"ntlm/messages"
+	"testing"
+)
+
+func authenticateWithTargetName(version Version, spn string, untrusted bool, required bool) error {
+	server, _ := CreateServerSession(version, ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain")
+	server.SetAcceptedTargetNames([]string{"HTTP/web01.example.com", "HTTP/web01"}, required)
+	client, _ := CreateClientSession(version, ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain")
+	client.SetTargetName(spn, untrusted)
+	return handshakeError(client, server)
+}
+
+func TestTargetName(t *testing.T) {
+	if err := authenticateWithTargetName(Version2, "http/WEB01.example.com", false, true); err != nil {
+		t.Errorf("Accepted target name was rejected: %s", err)
+	}
+	if err := authenticateWithTargetName(Version2, "CIFS/web01.example.com", false, false); err != ErrTargetName {
+		t.Errorf("Expected ErrTargetName for another service but got %v", err)
+	}
+	if err := authenticateWithTargetName(Version2, "", false, false); err != nil {
+		t.Errorf("Client without target name was not accepted: %s", err)
+	}
+	if err := authenticateWithTargetName(Version2, "", false, true); err != ErrTargetName {
+		t.Errorf("Expected ErrTargetName for a missing target name but got %v", err)
+	}
+	if err := authenticateWithTargetName(Version2, "HTTP/web01.example.com", true, true); err != ErrTargetName {
+		t.Errorf("Expected ErrTargetName for a target name from an untrusted source but got %v", err)
+	}
+	if err := authenticateWithTargetName(Version1, "HTTP/web01.example.com", false, true); err != ErrTargetName {
+		t.Errorf("Expected ErrTargetName for an NTLMv1 client but got %v", err)
+	}
+
+	// The client sends the name and the untrusted bit in its AvPairs
+	pairs := new(messages.AvPairs)
+	pairs.AddAvPair(messages.MsvAvEOL, make([]byte, 0))
+	client := new(V2ClientSession)
+	client.SetTargetName("HTTP/web01", true)
+	client.addTargetName(pairs)
+	if pairs.StringValue(messages.MsvAvTargetName) != "HTTP/web01" || pairs.Flags()&messages.MsvAvFlagUntrustedSPNSource == 0 {
+		t.Errorf("Target name was not added to the AvPairs: %s", pairs.String())
+	}
+}
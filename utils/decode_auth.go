@@ -8,12 +8,21 @@ import (
 )
 
 func main() {
-	var ntlmVersion = flag.Int("ntlm", 2, "NTLM version to try: 1 or 2")
+	// The version is detected from the message, the flag only checks it
+	var ntlmVersion = flag.Int("ntlm", 0, "NTLM version the message must have: 1 or 2, 0 for either")
 	flag.Parse()
 	var data string
 	fmt.Println("Paste the base64 encoded Authenticate message (with no line breaks):")
 	fmt.Scanf("%s", &data)
 	authenticateData, _ := base64.StdEncoding.DecodeString(data)
-	a, _ := messages.ParseAuthenticateMessage(authenticateData, *ntlmVersion)
-	fmt.Printf(a.String())
+	a, err := messages.ParseAuthenticateMessage(authenticateData)
+	if err != nil {
+		fmt.Printf("Error ParseAuthenticateMessage , %s\n", err)
+		return
+	}
+	if *ntlmVersion != 0 && a.NtlmVersion() != *ntlmVersion {
+		fmt.Printf("The message has an NTLMv%d response, not NTLMv%d\n", a.NtlmVersion(), *ntlmVersion)
+		return
+	}
+	fmt.Print(a.String())
 }
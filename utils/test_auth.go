@@ -2,12 +2,17 @@ package main
 
 import (
 	"encoding/base64"
+	"flag"
 	"fmt"
 	"ntlm"
 	"ntlm/messages"
 )
 
 func main() {
+	// VersionAuto refuses NTLMv1 responses unless the level allows them
+	var level = flag.Int("level", 3, "LmCompatibilityLevel of the server: 0 to 4 accept NTLMv1, 5 only NTLMv2")
+	flag.Parse()
+
 	// ntlm v2
 	//	challengeMessage := "TlRMTVNTUAACAAAAAAAAADgAAABVgphiPXSy0E6+HrMAAAAAAAAAAKIAogA4AAAABQEoCgAAAA8CAA4AUgBFAFUAVABFAFIAUwABABwAVQBLAEIAUAAtAEMAQgBUAFIATQBGAEUAMAA2AAQAFgBSAGUAdQB0AGUAcgBzAC4AbgBlAHQAAwA0AHUAawBiAHAALQBjAGIAdAByAG0AZgBlADAANgAuAFIAZQB1AHQAZQByAHMALgBuAGUAdAAFABYAUgBlAHUAdABlAHIAcwAuAG4AZQB0AAAAAAA="
 	//	authenticateMessage := "TlRMTVNTUAADAAAAGAAYALYAAADSANIAzgAAADQANABIAAAAIAAgAHwAAAAaABoAnAAAABAAEACgAQAAVYKQQgUCzg4AAAAPYQByAHIAYQB5ADEAMgAuAG0AcwBnAHQAcwB0AC4AcgBlAHUAdABlAHIAcwAuAGMAbwBtAHUAcwBlAHIAcwB0AHIAZQBzAHMAMQAwADAAMAAwADgATgBZAEMAVgBBADEAMgBTADIAQwBNAFMAQQBPYrLjU4h0YlWZeEoNvTJtBQMnnJuAeUwsP+vGmAHNRBpgZ+4ChQLqAQEAAAAAAACPFEIFjx7OAQUDJ5ybgHlMAAAAAAIADgBSAEUAVQBUAEUAUgBTAAEAHABVAEsAQgBQAC0AQwBCAFQAUgBNAEYARQAwADYABAAWAFIAZQB1AHQAZQByAHMALgBuAGUAdAADADQAdQBrAGIAcAAtAGMAYgB0AHIAbQBmAGUAMAA2AC4AUgBlAHUAdABlAHIAcwAuAG4AZQB0AAUAFgBSAGUAdQB0AGUAcgBzAC4AbgBlAHQAAAAAAAAAAAANuvnqD3K88ZpjkLleL0NW"
@@ -24,8 +29,9 @@ func main() {
 	challengeMessage := "TlRMTVNTUAACAAAAAAAAADgAAABVgphiMx43owKH33MAAAAAAAAAAKIAogA4AAAABQEoCgAAAA8CAA4AUgBFAFUAVABFAFIAUwABABwAVQBLAEIAUAAtAEMAQgBUAFIATQBGAEUAMAA2AAQAFgBSAGUAdQB0AGUAcgBzAC4AbgBlAHQAAwA0AHUAawBiAHAALQBjAGIAdAByAG0AZgBlADAANgAuAFIAZQB1AHQAZQByAHMALgBuAGUAdAAFABYAUgBlAHUAdABlAHIAcwAuAG4AZQB0AAAAAAA="
 	authenticateMessage := "TlRMTVNTUAADAAAAGAAYAKwAAAAYABgAxAAAAAAAAABYAAAANgA2AFgAAAAeAB4AjgAAABAAEADcAAAAVYKQYgYBsR0AAAAPukU9WmBJLdSLU2NvXjNgUzAANQAwADAANAA1AC4AcgBtAHcAYQB0AGUAcwB0AEAAcgBlAHUAdABlAHIAcwAuAGMAbwBtAFcASQBOAC0AMABEAEQAQQBCAEsAQwAxAFUASQA4AOLIAEYvI6zgw2+MBf8xHSTZhIfVaKIIFuLIAEYvI6zgw2+MBf8xHSTZhIfVaKIIFroZDwl770tY/oFQk38nnuI="
 
-	server, err := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+	server, err := ntlm.CreateServerSession(ntlm.VersionAuto, ntlm.ConnectionlessMode)
 	server.SetUserInfo("050045.rmwatest@reuters.com", "Welcome1", "")
+	server.SetLmCompatibilityLevel(ntlm.LmCompatibilityLevel(*level))
 
 	challengeData, _ := base64.StdEncoding.DecodeString(challengeMessage)
 	c, _ := messages.ParseChallengeMessage(challengeData)
@@ -35,54 +41,25 @@ func main() {
 	fmt.Println("----- END Challenge Message ----- ")
 
 	authenticateData, _ := base64.StdEncoding.DecodeString(authenticateMessage)
-	var context ntlm.ServerSession
 
-	msg, err := messages.ParseAuthenticateMessage(authenticateData, 2)
+	msg, err := messages.ParseAuthenticateMessage(authenticateData)
 	if err != nil {
-		msg2, newErr := messages.ParseAuthenticateMessage(authenticateData, 1)
-		if newErr != nil {
-			fmt.Printf("Error ParseAuthenticateMessage , %s", err)
-			return
-		}
-
-		// Message parsed correctly as NTLMv1 so assume the session is v1 and reset the server session
-		newContext, err := ntlm.CreateServerSession(ntlm.Version1, ntlm.ConnectionlessMode)
-		newContext.SetUserInfo(server.GetUserInfo())
-		if err != nil {
-			fmt.Println("Could not create NTLMv1 session")
-			return
-		}
-
-		// Need the originally generated server challenge so we can process the response
-		newContext.SetServerChallenge(c.ServerChallenge)
-		//	err = server.ProcessAuthenticateMessage(msg)
-		err = newContext.ProcessAuthenticateMessage(msg2)
-		if err != nil {
-			fmt.Printf("Could not process authenticate v1 message: %s\n", err)
-			return
-		}
-		// Set the security context to now be NTLMv1
-		context = newContext
-		fmt.Println("----- Authenticate Message ----- ")
-		fmt.Println(msg2.String())
-		fmt.Println("----- END Authenticate Message ----- ")
-
-	} else {
-		context = server
-		// Need the server challenge to be set
-		server.SetServerChallenge(c.ServerChallenge)
+		fmt.Printf("Error ParseAuthenticateMessage , %s", err)
+		return
+	}
 
-		//	err = server.ProcessAuthenticateMessage(msg)
-		err = context.ProcessAuthenticateMessage(msg)
-		if err != nil {
-			fmt.Printf("Could not process authenticate message: %s\n", err)
-			return
-		}
-		fmt.Println("----- Authenticate Message ----- ")
-		fmt.Println(msg.String())
-		fmt.Println("----- END Authenticate Message ----- ")
+	// Need the originally generated server challenge so we can process the response
+	server.SetServerChallenge(c.ServerChallenge)
 
+	// The server detects whether the client sent an NTLMv1 or NTLMv2 response
+	err = server.ProcessAuthenticateMessage(msg)
+	if err != nil {
+		fmt.Printf("Could not process authenticate v%d message: %s\n", msg.NtlmVersion(), err)
+		return
 	}
+	fmt.Println("----- Authenticate Message ----- ")
+	fmt.Println(msg.String())
+	fmt.Println("----- END Authenticate Message ----- ")
 
 	fmt.Println("success")
 }